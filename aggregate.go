@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+
+	"github.com/ncabatoff/dbms_exporter/common"
+	"github.com/ncabatoff/dbms_exporter/db"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultQuantiles are the quantiles of SUMMARY columns that don't specify
+// any.
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// rowAggregate folds the rows of a resultset that share the same label
+// values into a single metric.
+type rowAggregate interface {
+	// add adds the row, whose aggregated column is at index idx.
+	// columnIdx maps column names to indices.
+	add(row []interface{}, idx int, columnIdx map[string]int) error
+	// metric returns the metric for the rows added.
+	metric() prometheus.Metric
+}
+
+// newAggregate returns a function creating the rowAggregate for a HISTOGRAM
+// or SUMMARY column, given the label values of the rows it will fold.
+func newAggregate(desc *prometheus.Desc, cm common.ColumnMapping) func(labels []string) rowAggregate {
+	if cm.Bucket != "" {
+		return func(labels []string) rowAggregate {
+			return &histogramRows{desc: desc, labels: labels, bucketColumn: cm.Bucket,
+				sumColumn: cm.Sum, buckets: make(map[float64]uint64)}
+		}
+	}
+	quantiles := cm.Quantiles
+	if cm.Usage == common.SUMMARY && len(quantiles) == 0 {
+		quantiles = defaultQuantiles
+	}
+	return func(labels []string) rowAggregate {
+		return &observedRows{desc: desc, labels: labels, regexp: cm.Regexp,
+			buckets: cm.Buckets, quantiles: quantiles}
+	}
+}
+
+// histogramRows folds the rows of a HISTOGRAM column, each counting the
+// observations in the bucket given by another column, into a histogram.
+type histogramRows struct {
+	desc                    *prometheus.Desc
+	labels                  []string
+	bucketColumn, sumColumn string
+	count                   uint64
+	sum                     float64
+	// buckets holds the count of each bucket by upper bound, excluding
+	// the +Inf bucket.
+	buckets map[float64]uint64
+}
+
+// add implements rowAggregate.  A NULL upper bound means +Inf, and a NULL sum
+// zero.
+func (h *histogramRows) add(row []interface{}, idx int, columnIdx map[string]int) error {
+	var ibound, isum interface{}
+	if i, ok := columnIdx[h.bucketColumn]; ok {
+		ibound = row[i]
+	}
+	if i, ok := columnIdx[h.sumColumn]; ok {
+		isum = row[i]
+	}
+
+	count, ok := db.ToFloat64(row[idx], nil)
+	if !ok || math.IsNaN(count) || count < 0 {
+		return fmt.Errorf("bad count %v", row[idx])
+	}
+	bound := math.Inf(1)
+	if ibound != nil {
+		if bound, ok = db.ToFloat64(ibound, nil); !ok || math.IsNaN(bound) {
+			return fmt.Errorf("bad bucket upper bound %v", ibound)
+		}
+	}
+	var sum float64
+	if isum != nil {
+		if sum, ok = db.ToFloat64(isum, nil); !ok || math.IsNaN(sum) {
+			return fmt.Errorf("bad sum %v", isum)
+		}
+	}
+
+	h.count += uint64(count)
+	h.sum += sum
+	if !math.IsInf(bound, 1) {
+		h.buckets[bound] += uint64(count)
+	}
+	return nil
+}
+
+// metric implements rowAggregate.
+func (h *histogramRows) metric() prometheus.Metric {
+	bounds := make([]float64, 0, len(h.buckets))
+	for bound := range h.buckets {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	// Const histograms expect cumulative counts.
+	cumulative := make(map[float64]uint64, len(bounds))
+	var total uint64
+	for _, bound := range bounds {
+		total += h.buckets[bound]
+		cumulative[bound] = total
+	}
+	return prometheus.MustNewConstHistogram(h.desc, h.count, h.sum, cumulative, h.labels...)
+}
+
+// observedRows observes the value of a HISTOGRAM column with buckets or of a
+// SUMMARY column in each row, yielding a histogram or summary.
+type observedRows struct {
+	desc      *prometheus.Desc
+	labels    []string
+	regexp    *regexp.Regexp
+	buckets   []float64
+	quantiles []float64
+	values    []float64
+}
+
+// add implements rowAggregate.  NULLs aren't observed.
+func (o *observedRows) add(row []interface{}, idx int, columnIdx map[string]int) error {
+	value, ok := db.ToFloat64(row[idx], o.regexp)
+	if !ok {
+		return fmt.Errorf("bad value %v", row[idx])
+	}
+	if !math.IsNaN(value) {
+		o.values = append(o.values, value)
+	}
+	return nil
+}
+
+// metric implements rowAggregate.
+func (o *observedRows) metric() prometheus.Metric {
+	sort.Float64s(o.values)
+	var sum float64
+	for _, value := range o.values {
+		sum += value
+	}
+	count := uint64(len(o.values))
+
+	if o.quantiles != nil {
+		quantiles := make(map[float64]float64, len(o.quantiles))
+		for _, q := range o.quantiles {
+			quantiles[q] = quantile(q, o.values)
+		}
+		return prometheus.MustNewConstSummary(o.desc, count, sum, quantiles, o.labels...)
+	}
+
+	buckets := make(map[float64]uint64, len(o.buckets))
+	for _, bound := range o.buckets {
+		buckets[bound] = uint64(sort.Search(len(o.values), func(i int) bool { return o.values[i] > bound }))
+	}
+	return prometheus.MustNewConstHistogram(o.desc, count, sum, buckets, o.labels...)
+}
+
+// quantile returns the q-quantile of the sorted values using the nearest
+// rank method, or NaN if there are none.
+func quantile(q float64, values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	rank := int(math.Ceil(q*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return values[rank]
+}
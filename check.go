@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ncabatoff/dbms_exporter/config"
+)
+
+// checkRecipes validates the recipe files named by the command line: those of
+// each target of cfg if not nil, otherwise queriesPaths, and those of the
+// probe modules.  It reports every problem found on stderr and returns how
+// many there were.
+func checkRecipes(cfg *config.ExporterConfig, queriesPaths []string, driver string, modulePaths map[string]string) int {
+	var checkers []*config.RecipeChecker
+	drivers := map[string]bool{}
+	if cfg != nil {
+		for _, name := range cfg.TargetNames() {
+			t := cfg.Targets[name]
+			labels := []string{"target"}
+			for l := range t.Labels {
+				labels = append(labels, l)
+			}
+			rc := config.NewRecipeChecker(t.Driver, labels)
+			rc.CheckFiles(t.RecipeFiles)
+			checkers = append(checkers, rc)
+			drivers[t.Driver] = true
+		}
+	} else {
+		rc := config.NewRecipeChecker(driver, nil)
+		rc.CheckFiles(queriesPaths)
+		checkers = append(checkers, rc)
+		drivers[driver] = true
+	}
+
+	// Modules may be used with any target, so check them with each driver.
+	modules := make([]string, 0, len(modulePaths))
+	for module := range modulePaths {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+	for _, module := range modules {
+		for d := range drivers {
+			rc := config.NewRecipeChecker(d, nil)
+			rc.CheckFiles([]string{modulePaths[module]})
+			checkers = append(checkers, rc)
+		}
+	}
+
+	// The same file may be checked more than once, e.g. when used by
+	// several targets; only report each problem once.
+	seen := make(map[string]bool)
+	for _, rc := range checkers {
+		for _, ce := range rc.Errors() {
+			msg := ce.Error()
+			if !seen[msg] {
+				seen[msg] = true
+				fmt.Fprintln(os.Stderr, msg)
+			}
+		}
+	}
+	return len(seen)
+}
@@ -3,6 +3,7 @@ package common
 import (
 	"fmt"
 	"regexp"
+	"time"
 )
 
 // ColumnUsage is an enum type differentiating different column handling behaviours.
@@ -17,6 +18,20 @@ const (
 	MAPPEDMETRIC ColumnUsage = iota // Use this column with the supplied mapping of text values
 	DURATION     ColumnUsage = iota // This column should be interpreted as a text duration (and converted to milliseconds)
 	FIXED        ColumnUsage = iota // This is not a column but rather a constant label that should be added to the metrics
+	HISTOGRAM    ColumnUsage = iota // Rows are folded into a histogram, either counting observations in the bucket given by another column or observing the column's value
+	SUMMARY      ColumnUsage = iota // The column's value is observed across rows, yielding a summary with quantiles
+	INFO         ColumnUsage = iota // Use this column as a label of the namespace's _info metric, whose value is always 1
+	STATESET     ColumnUsage = iota // Create a 0/1 series for each of the supplied states, 1 for the one matching this column's text
+	TIMESTAMP    ColumnUsage = iota // Use this column as the timestamp of the samples from its row
+)
+
+const (
+	// DefaultMaxAge is how old a TIMESTAMP may be before it's dropped, if
+	// the column doesn't say otherwise.
+	DefaultMaxAge = time.Hour
+	// DefaultMaxFuture is how far ahead of the exporter's clock a TIMESTAMP
+	// may be before it's dropped, if the column doesn't say otherwise.
+	DefaultMaxFuture = 5 * time.Minute
 )
 
 // ColumnMapping defines how to build metrics from a given DB column.  Recipes
@@ -25,9 +40,18 @@ const (
 type ColumnMapping struct {
 	Usage       ColumnUsage
 	Description string
-	Mapping     map[string]float64 // Optional column mapping for MAPPEDMETRIC
+	Mapping     map[string]float64 // Column mapping for MAPPEDMETRIC, keyed by lower-cased text
+	Default     *float64           // Optional value for MAPPEDMETRIC text not in Mapping
 	Regexp      *regexp.Regexp
 	Fixedval    string
+	Bucket      string         // Column holding the bucket upper bound for HISTOGRAM
+	Sum         string         // Column holding the sum of observed values for HISTOGRAM
+	Buckets     []float64      // Bucket upper bounds for a HISTOGRAM observing the column's value
+	Quantiles   []float64      // Quantiles for SUMMARY
+	States      []string       // States for STATESET
+	MaxAge      time.Duration  // Oldest TIMESTAMP kept, DefaultMaxAge if zero
+	MaxFuture   time.Duration  // Furthest ahead TIMESTAMP kept, DefaultMaxFuture if zero
+	Location    *time.Location // Time zone of TIMESTAMP text without one, time.Local if nil
 }
 
 // StringToColumnUsage converts a string to the corresponding ColumnUsage.
@@ -47,6 +71,16 @@ func StringToColumnUsage(s string) (u ColumnUsage, err error) {
 		u = DURATION
 	case "FIXED":
 		u = FIXED
+	case "HISTOGRAM":
+		u = HISTOGRAM
+	case "SUMMARY":
+		u = SUMMARY
+	case "INFO":
+		u = INFO
+	case "STATESET":
+		u = STATESET
+	case "TIMESTAMP":
+		u = TIMESTAMP
 	default:
 		err = fmt.Errorf("wrong ColumnUsage given : %s", s)
 	}
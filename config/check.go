@@ -0,0 +1,380 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ncabatoff/dbms_exporter/common"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	metricNameRE = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+	yamlLineRE   = regexp.MustCompile(`line (\d+): `)
+)
+
+// CheckError is a problem found in a recipe file.
+type CheckError struct {
+	File string
+	// Line is the line of the file the problem was found at, or 0 if
+	// unknown.
+	Line int
+	// Path identifies the recipe, resultset and metric the problem
+	// concerns, e.g. "pg_locks/count".  It's empty for file-wide problems.
+	Path string
+	Msg  string
+}
+
+// Error implements error.
+func (ce CheckError) Error() string {
+	loc := ce.File
+	if ce.Line > 0 {
+		loc += ":" + strconv.Itoa(ce.Line)
+	}
+	if ce.Path != "" {
+		loc += ": " + ce.Path
+	}
+	return loc + ": " + ce.Msg
+}
+
+// RecipeChecker validates recipe files, collecting every problem found
+// rather than stopping at the first one like ReadRecipesFile does.  Files
+// checked by the same RecipeChecker are assumed to be used together, so
+// they mustn't define the same metric twice.
+type RecipeChecker struct {
+	prefix string
+	// labels are the label names the exporter adds to all metrics.
+	labels map[string]bool
+	errs   []CheckError
+	// metrics maps the metric names generated so far to where they were
+	// defined.
+	metrics map[string]string
+	// namespaces maps the recipe namespaces seen so far to the files
+	// defining them.
+	namespaces map[string]string
+	// read holds the absolute paths of the files checked so far.
+	read map[string]bool
+}
+
+// NewRecipeChecker returns a checker for recipes read with the given prefix,
+// whose metrics will additionally carry the given labels.
+func NewRecipeChecker(prefix string, labels []string) *RecipeChecker {
+	rc := &RecipeChecker{
+		prefix:     prefix,
+		labels:     make(map[string]bool),
+		metrics:    make(map[string]string),
+		namespaces: make(map[string]string),
+		read:       make(map[string]bool),
+	}
+	for _, l := range labels {
+		rc.labels[l] = true
+	}
+	return rc
+}
+
+// Errors returns the problems found so far, sorted by location.
+func (rc *RecipeChecker) Errors() []CheckError {
+	sort.SliceStable(rc.errs, func(i, j int) bool {
+		if rc.errs[i].File != rc.errs[j].File {
+			return rc.errs[i].File < rc.errs[j].File
+		}
+		return rc.errs[i].Line < rc.errs[j].Line
+	})
+	return rc.errs
+}
+
+// CheckFiles checks the files named by patterns, as expanded by
+// ExpandRecipePaths.
+func (rc *RecipeChecker) CheckFiles(patterns []string) {
+	paths, err := ExpandRecipePaths(patterns, "")
+	if err != nil {
+		rc.errs = append(rc.errs, CheckError{File: strings.Join(patterns, ","), Msg: err.Error()})
+		return
+	}
+	for _, path := range paths {
+		rc.CheckFile(path)
+	}
+}
+
+// CheckFile reads and checks the named recipe file and the files it
+// includes.  Files already checked are skipped.
+func (rc *RecipeChecker) CheckFile(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		if rc.read[abs] {
+			return
+		}
+		rc.read[abs] = true
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		rc.errs = append(rc.errs, CheckError{File: path, Msg: err.Error()})
+		return
+	}
+	rc.Check(path, string(content))
+}
+
+// Check checks recipes read from content; file is used to report the
+// location of problems.
+func (rc *RecipeChecker) Check(file, content string) {
+	var yamldata map[string]interface{}
+	err := yaml.UnmarshalStrict([]byte(content), &yamldata)
+	if te, ok := err.(*yaml.TypeError); ok {
+		// Duplicate keys, which ReadRecipesFile silently ignores.
+		for _, msg := range te.Errors {
+			rc.errs = append(rc.errs, yamlCheckError(file, msg))
+		}
+		yamldata = nil
+		err = yaml.Unmarshal([]byte(content), &yamldata)
+	}
+	if err != nil {
+		rc.errs = append(rc.errs, yamlCheckError(file, err.Error()))
+		return
+	}
+
+	fc := &fileChecker{
+		RecipeChecker: rc,
+		file:          file,
+		lines:         strings.Split(content, "\n"),
+		metricLines:   make(map[string]int),
+	}
+	names := make([]string, 0, len(yamldata))
+	for name := range yamldata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var includes []string
+	for _, name := range names {
+		if name == includeKey {
+			includes, err = getIncludes(yamldata[name])
+			if err != nil {
+				fc.errorf(fc.findLine(1, 0, name, true), name, "%v", err)
+			}
+			continue
+		}
+		fc.checkRecipe(name, yamldata[name])
+	}
+
+	paths, err := ExpandRecipePaths(includes, filepath.Dir(file))
+	if err != nil {
+		fc.errorf(fc.findLine(1, 0, includeKey, true), includeKey, "%v", err)
+		return
+	}
+	for _, path := range paths {
+		rc.CheckFile(path)
+	}
+}
+
+// yamlCheckError returns a CheckError for a YAML parser error message.
+func yamlCheckError(file, msg string) CheckError {
+	ce := CheckError{File: file, Msg: msg}
+	if m := yamlLineRE.FindStringSubmatchIndex(msg); m != nil {
+		ce.Line, _ = strconv.Atoi(msg[m[2]:m[3]])
+		ce.Msg = msg[:m[0]] + msg[m[1]:]
+	}
+	return ce
+}
+
+// fileChecker checks the recipes of a single file.
+type fileChecker struct {
+	*RecipeChecker
+	file  string
+	lines []string
+	// metricLines maps metric paths to the lines defining them.
+	metricLines map[string]int
+}
+
+func (fc *fileChecker) errorf(line int, path, format string, args ...interface{}) {
+	fc.errs = append(fc.errs, CheckError{File: fc.file, Line: line, Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// findLine returns the number of the first line at or after line from and
+// before line to that declares key, or 0 if there's none.  Lines are
+// numbered from 1; to may be 0 to search to the end of the file.  Top-level
+// keys must be unindented; others may be list items.
+func (fc *fileChecker) findLine(from, to int, key string, topLevel bool) int {
+	prefix := `^\s*(-\s*)?`
+	if topLevel {
+		prefix = `^`
+	}
+	re := regexp.MustCompile(prefix + `["']?` + regexp.QuoteMeta(key) + `["']?\s*:`)
+	if to == 0 || to > len(fc.lines)+1 {
+		to = len(fc.lines) + 1
+	}
+	if from < 1 {
+		from = 1
+	}
+	for i := from; i < to; i++ {
+		if re.MatchString(fc.lines[i-1]) {
+			return i
+		}
+	}
+	return 0
+}
+
+// recipeLines returns the range of lines holding the named recipe.
+func (fc *fileChecker) recipeLines(name string) (int, int) {
+	start := fc.findLine(1, 0, name, true)
+	if start == 0 {
+		return 0, 0
+	}
+	for i := start + 1; i <= len(fc.lines); i++ {
+		l := fc.lines[i-1]
+		if l != "" && l[0] != ' ' && l[0] != '\t' && l[0] != '#' {
+			return start, i
+		}
+	}
+	return start, len(fc.lines) + 1
+}
+
+func (fc *fileChecker) checkRecipe(name string, specs interface{}) {
+	start, end := fc.recipeLines(name)
+	nerrs := len(fc.errs)
+
+	// Check each metric on its own, so that all bad metrics are reported.
+	if yamlRecipe, ok := specs.(map[interface{}]interface{}); ok {
+		if imetrics, ok := yamlRecipe["metrics"]; ok {
+			fc.checkMetrics(name, start, end, imetrics)
+		}
+		if irss, ok := yamlRecipe["resultsets"].([]interface{}); ok {
+			line := start
+			for _, irs := range irss {
+				rs, ok := irs.(map[interface{}]interface{})
+				if !ok || len(rs) != 1 {
+					continue
+				}
+				for irname, irvalue := range rs {
+					rname, _ := irname.(string)
+					if rname == "discard" {
+						continue
+					}
+					if l := fc.findLine(line, end, rname, false); l > 0 {
+						line = l
+					}
+					// As in the exporter, a resultset named metrics
+					// gets no suffix.
+					path := name
+					if rname != "metrics" {
+						path += "/" + rname
+					}
+					fc.checkMetrics(path, line, end, irvalue)
+				}
+			}
+		}
+	}
+	if len(fc.errs) > nerrs {
+		return
+	}
+
+	recipe, err := getRecipe(fc.prefix, name, specs)
+	if err != nil {
+		fc.errorf(start, name, "%v", err)
+		return
+	}
+	if prev, dup := fc.namespaces[recipe.GetNamespace()]; dup {
+		fc.errorf(start, name, "namespace %q already defined in %s", recipe.GetNamespace(), prev)
+		return
+	}
+	fc.namespaces[recipe.GetNamespace()] = fc.file
+
+	for _, nrm := range recipe.GetResultMaps() {
+		if nrm.ShouldSkip() {
+			continue
+		}
+		metricName := recipe.GetNamespace()
+		path := name
+		if nrm.Name != "metrics" {
+			metricName += "_" + nrm.Name
+			path += "/" + nrm.Name
+		}
+		columns := make([]string, 0, len(nrm.ResultMap))
+		for column := range nrm.ResultMap {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		var hasInfo bool
+		for _, column := range columns {
+			var fullName string
+			switch nrm.ResultMap[column].Usage {
+			case common.INFO:
+				if hasInfo {
+					continue
+				}
+				hasInfo = true
+				fullName = metricName + "_info"
+			case common.COUNTER, common.GAUGE, common.MAPPEDMETRIC, common.HISTOGRAM, common.SUMMARY, common.STATESET:
+				fullName = metricName + "_" + column
+			case common.DURATION:
+				fullName = metricName + "_" + column + "_milliseconds"
+			default:
+				continue
+			}
+			mpath := path + "/" + column
+			line := fc.metricLines[mpath]
+			if !metricNameRE.MatchString(fullName) {
+				fc.errorf(line, mpath, "invalid metric name %q", fullName)
+				continue
+			}
+			where := fmt.Sprintf("%s:%d: %s", fc.file, line, mpath)
+			if prev, dup := fc.metrics[fullName]; dup {
+				fc.errorf(line, mpath, "metric %q already defined at %s", fullName, prev)
+				continue
+			}
+			fc.metrics[fullName] = where
+		}
+	}
+}
+
+// checkMetrics checks a list of metric definitions found between lines
+// start and end.
+func (fc *fileChecker) checkMetrics(path string, start, end int, imetrics interface{}) {
+	list, ok := imetrics.([]interface{})
+	if !ok {
+		fc.errorf(start, path, "metrics %v is not a list", imetrics)
+		return
+	}
+
+	line := start
+	seen := make(map[string]bool)
+	for i, imetric := range list {
+		name, cmap, err := getMetric(imetric)
+		mpath := fmt.Sprintf("%s/metric %d", path, i+1)
+		if name != "" {
+			mpath = path + "/" + name
+			// Metric names may have had spaces replaced by underscores.
+			if l := fc.findLine(line+1, end, name, false); l > 0 {
+				line = l
+			} else if l := fc.findLine(line+1, end, strings.Replace(name, "_", " ", -1), false); l > 0 {
+				line = l
+			}
+			fc.metricLines[mpath] = line
+		}
+		if err != nil {
+			fc.errorf(line, mpath, "%v", err)
+			continue
+		}
+
+		if seen[name] {
+			fc.errorf(line, mpath, "column %q defined more than once", name)
+		}
+		seen[name] = true
+
+		if cmap.Regexp != nil && cmap.Regexp.NumSubexp() == 0 {
+			fc.errorf(line, mpath, "regexp %q has no capture group", cmap.Regexp.String())
+		}
+
+		// STATESET columns label their series with the state.
+		if cmap.Usage == common.LABEL || cmap.Usage == common.FIXED || cmap.Usage == common.INFO || cmap.Usage == common.STATESET {
+			switch {
+			case !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__"):
+				fc.errorf(line, mpath, "invalid label name %q", name)
+			case fc.labels[name]:
+				fc.errorf(line, mpath, "label %q collides with a label added by the exporter", name)
+			}
+		}
+	}
+}
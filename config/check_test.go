@@ -0,0 +1,85 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecipeChecker(t *testing.T) {
+	content := `recipe1:
+  metrics:
+    - met1:
+        usage: GAUGE
+        description: desc1
+        regexp: "(["
+    - met2:
+        usage: GAUGE
+        description: desc2
+        regexp: "\\d+"
+    - bad-label:
+        usage: LABEL
+    - target:
+        usage: LABEL
+recipe2:
+  interval: often
+  metrics:
+    - met1:
+        usage: GAUGE
+        description: desc1
+recipe3:
+  metrics:
+    - lab:
+        usage: LABEL
+    - lab:
+        usage: FIXED
+        description: fixed
+        value: val
+recipe3_lab:
+  resultsets:
+    - met:
+        - c:
+            usage: COUNTER
+            description: c
+recipe3_lab_met:
+  metrics:
+    - c:
+        usage: GAUGE
+        description: c
+`
+	rc := NewRecipeChecker("test", []string{"target"})
+	rc.Check("test.yaml", content)
+
+	want := []string{
+		`test.yaml:3: recipe1/met1: bad regexp "(["`,
+		`test.yaml:7: recipe1/met2: regexp "\\d+" has no capture group`,
+		`test.yaml:11: recipe1/bad-label: invalid label name "bad-label"`,
+		`test.yaml:13: recipe1/target: label "target" collides`,
+		`test.yaml:15: recipe2: bad interval "often"`,
+		`test.yaml:25: recipe3/lab: column "lab" defined more than once`,
+		`test.yaml:37: recipe3_lab_met/c: metric "test_recipe3_lab_met_c" already defined at test.yaml:32: recipe3_lab/met/c`,
+	}
+	errs := rc.Errors()
+	if len(errs) != len(want) {
+		t.Errorf("got %d errors, want %d: %v", len(errs), len(want), errs)
+	}
+	for i := 0; i < len(errs) && i < len(want); i++ {
+		if !strings.HasPrefix(errs[i].Error(), want[i]) {
+			t.Errorf("error %d is %q, want prefix %q", i, errs[i].Error(), want[i])
+		}
+	}
+}
+
+func TestRecipeCheckerYAML(t *testing.T) {
+	rc := NewRecipeChecker("test", nil)
+	rc.Check("test.yaml", "recipe1:\n  metrics: []\nrecipe1:\n  metrics: []\n")
+	errs := rc.Errors()
+	if len(errs) != 1 || errs[0].Line == 0 || !strings.Contains(errs[0].Msg, `"recipe1" already set`) {
+		t.Errorf("got %v, want duplicate recipe1 error", errs)
+	}
+
+	rc = NewRecipeChecker("test", nil)
+	rc.Check("test.yaml", "recipe1:\n  metrics: [\n")
+	if errs := rc.Errors(); len(errs) != 1 || errs[0].Line != 2 {
+		t.Errorf("got %v, want syntax error at line 2", errs)
+	}
+}
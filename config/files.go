@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ncabatoff/dbms_exporter/recipes"
+)
+
+// includeKey is the top-level key of a recipe file listing other recipe
+// files to read; it can't be used as a recipe name.
+const includeKey = "include"
+
+// ExpandRecipePaths turns patterns into a list of files.  Each pattern may
+// name a file, a directory, meaning the .yaml and .yml files in it, or be a
+// glob.  Relative patterns are taken relative to dir, if not empty.
+func ExpandRecipePaths(patterns []string, dir string) ([]string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		if dir != "" && !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			var err error
+			matches, err = filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", pattern)
+			}
+		}
+		for _, match := range matches {
+			fi, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !fi.IsDir() {
+				paths = append(paths, match)
+				continue
+			}
+			var dirPaths []string
+			for _, ext := range []string{"*.yaml", "*.yml"} {
+				m, _ := filepath.Glob(filepath.Join(match, ext))
+				dirPaths = append(dirPaths, m...)
+			}
+			sort.Strings(dirPaths)
+			paths = append(paths, dirPaths...)
+		}
+	}
+	return paths, nil
+}
+
+// ReadRecipesFiles reads the recipes in the files named by patterns, as
+// expanded by ExpandRecipePaths, along with the files they include, in
+// order.  Each file is read only once, and it's an error for two files to
+// define the same namespace.  All resulting metrics will be prefixed by
+// prefix_.
+func ReadRecipesFiles(patterns []string, prefix string) ([]recipes.MetricQueryRecipe, error) {
+	paths, err := ExpandRecipePaths(patterns, "")
+	if err != nil {
+		return nil, err
+	}
+	rr := &recipeReader{
+		prefix:     prefix,
+		read:       make(map[string]bool),
+		namespaces: make(map[string]string),
+	}
+	for _, path := range paths {
+		if err := rr.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return rr.recipes, nil
+}
+
+// recipeReader accumulates the recipes of several files.
+type recipeReader struct {
+	prefix string
+	// read holds the absolute paths of the files read so far.
+	read map[string]bool
+	// namespaces maps the namespaces of the recipes read so far to the
+	// files defining them.
+	namespaces map[string]string
+	recipes    []recipes.MetricQueryRecipe
+}
+
+func (rr *recipeReader) readFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if rr.read[abs] {
+		return nil
+	}
+	rr.read[abs] = true
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rcps, includes, err := getRecipes(rr.prefix, string(content))
+	if err != nil {
+		return fmt.Errorf("error parsing file %q: %v", path, err)
+	}
+	for _, recipe := range rcps {
+		namespace := recipe.GetNamespace()
+		if prev, dup := rr.namespaces[namespace]; dup {
+			return fmt.Errorf("namespace %q defined in both %q and %q", namespace, prev, path)
+		}
+		rr.namespaces[namespace] = path
+	}
+	rr.recipes = append(rr.recipes, rcps...)
+
+	paths, err := ExpandRecipePaths(includes, filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("error in includes of file %q: %v", path, err)
+	}
+	for _, ipath := range paths {
+		if err := rr.readFile(ipath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getIncludes returns the patterns listed by an include directive, which
+// may be a single string or a list of them.
+func getIncludes(value interface{}) ([]string, error) {
+	if s, ok := value.(string); ok {
+		return []string{s}, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s %v is neither a string nor a list", includeKey, value)
+	}
+	var includes []string
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s %v is not a string", includeKey, item)
+		}
+		includes = append(includes, s)
+	}
+	return includes, nil
+}
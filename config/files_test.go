@@ -0,0 +1,74 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func recipeYAML(names ...string) string {
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name + ":\n  metrics:\n    - met1:\n        usage: GAUGE\n        description: desc1\n")
+	}
+	return sb.String()
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadRecipesFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recipes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"main.yaml":         "include: [extra, \"perdb-*.yaml\"]\n" + recipeYAML("main1", "main2"),
+		"extra/b.yaml":      recipeYAML("b1"),
+		"extra/a.yml":       "include: ../main.yaml\n" + recipeYAML("a1"),
+		"extra/ignored.txt": "not yaml",
+		"perdb-x.yaml":      recipeYAML("x1"),
+		"dup.yaml":          recipeYAML("b1"),
+	})
+
+	rcps, err := ReadRecipesFiles([]string{filepath.Join(dir, "main.yaml")}, "test")
+	if err != nil {
+		t.Fatalf("unable to read recipes: %v", err)
+	}
+	var got []string
+	for _, r := range rcps {
+		got = append(got, r.GetNamespace())
+	}
+	want := []string{"test_main1", "test_main2", "test_a1", "test_b1", "test_x1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got recipes %v, want %v", got, want)
+	}
+
+	_, err = ReadRecipesFiles([]string{filepath.Join(dir, "extra"), filepath.Join(dir, "dup.yaml")}, "test")
+	if err == nil || !strings.Contains(err.Error(), `namespace "test_b1" defined in both`) {
+		t.Errorf("got error %v, want duplicate namespace error", err)
+	}
+
+	_, err = ReadRecipesFiles([]string{filepath.Join(dir, "nomatch-*.yaml")}, "test")
+	if err == nil || !strings.Contains(err.Error(), "no files match") {
+		t.Errorf("got error %v, want no match error", err)
+	}
+
+	if _, err := GetRecipes("test", "include: a.yaml\n"); err == nil {
+		t.Errorf("expected error for include outside a file")
+	}
+}
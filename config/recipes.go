@@ -2,47 +2,84 @@ package config
 
 import (
 	"fmt"
-	"io/ioutil"
 	"regexp"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/ncabatoff/dbms_exporter/common"
+	"github.com/ncabatoff/dbms_exporter/db"
 	"github.com/ncabatoff/dbms_exporter/recipes"
 	"gopkg.in/yaml.v2"
 )
 
-// ReadRecipesFile opens the named file and extracts recipes from it.  All
-// resulting metrics will be prefixed by prefix_.
+// ReadRecipesFile opens the named file and extracts recipes from it and the
+// files it includes.  All resulting metrics will be prefixed by prefix_.
 func ReadRecipesFile(queriesPath, prefix string) ([]recipes.MetricQueryRecipe, error) {
-	content, err := ioutil.ReadFile(queriesPath)
+	return ReadRecipesFiles([]string{queriesPath}, prefix)
+}
+
+// GetRecipes extracts recipes from content.  All resulting metrics will be
+// prefixed by prefix_.  Content read from elsewhere than a file may not
+// include other files.
+func GetRecipes(prefix, content string) ([]recipes.MetricQueryRecipe, error) {
+	rcps, includes, err := getRecipes(prefix, content)
 	if err != nil {
 		return nil, err
 	}
-	return GetRecipes(prefix, string(content))
+	if len(includes) > 0 {
+		return nil, fmt.Errorf("%s is only supported in recipe files", includeKey)
+	}
+	return rcps, nil
 }
 
-// GetRecipes extracts recipes from content.  All resulting metrics will be
-// prefixed by prefix_.
-func GetRecipes(prefix, content string) ([]recipes.MetricQueryRecipe, error) {
+// getRecipes extracts recipes from content, in order, along with the
+// patterns of any include directive.
+func getRecipes(prefix, content string) ([]recipes.MetricQueryRecipe, []string, error) {
 	var yamldata map[string]interface{}
 
 	err := yaml.Unmarshal([]byte(content), &yamldata)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	// Unmarshal again into a MapSlice, only to learn the order of the
+	// recipes in the file; nested MapSlices are awkward to work with.
+	var order yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(content), &order); err != nil {
+		return nil, nil, err
+	}
+
+	var includes []string
+	if value, ok := yamldata[includeKey]; ok {
+		includes, err = getIncludes(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		delete(yamldata, includeKey)
 	}
 
 	var recipes []recipes.MetricQueryRecipe
-	for basename, specs := range yamldata {
+	for _, item := range order {
+		basename, ok := item.Key.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("recipe name %v is not a string", item.Key)
+		}
+		specs, ok := yamldata[basename]
+		if !ok {
+			// The include directive, or a duplicate key whose last
+			// value was kept.
+			continue
+		}
+		delete(yamldata, basename)
 		recipe, err := getRecipe(prefix, basename, specs)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse recipe %q: %s", basename, err)
+			return nil, nil, fmt.Errorf("unable to parse recipe %q: %s", basename, err)
 		}
 		recipes = append(recipes, recipe)
 	}
 
-	return recipes, nil
+	return recipes, includes, nil
 }
 
 func getRecipe(prefix, namespace string, specs interface{}) (recipes.MetricQueryRecipe, error) {
@@ -54,9 +91,15 @@ func getRecipe(prefix, namespace string, specs interface{}) (recipes.MetricQuery
 
 	var query string
 	var queries []string
-	var rangeover string
+	var queryVersions []recipes.VersionRange
+	var versions recipes.VersionRange
+	var when *recipes.Condition
+	var rangeover []string
 	var resultmaps recipes.MultiResultMap
 	var resultmap recipes.ResultMap
+	var interval, timeout time.Duration
+	var priority int
+	var parallel int
 
 	for ikey, ivalue := range yamlRecipe {
 		key, ok := ikey.(string)
@@ -66,9 +109,9 @@ func getRecipe(prefix, namespace string, specs interface{}) (recipes.MetricQuery
 
 		switch key {
 		case "rangeover":
-			rangeover, ok = ivalue.(string)
-			if !ok {
-				return nil, fmt.Errorf("rangeover %v is not a string", ivalue)
+			var err error
+			if rangeover, err = getRangeover(ivalue); err != nil {
+				return nil, err
 			}
 
 		case "query":
@@ -82,12 +125,18 @@ func getRecipe(prefix, namespace string, specs interface{}) (recipes.MetricQuery
 			if !ok {
 				return nil, fmt.Errorf("queries %v is not a list", ivalue)
 			}
+			var limited bool
 			for i, iquery := range iqueries {
-				query, ok := iquery.(string)
-				if !ok {
-					return nil, fmt.Errorf("query %d (%v) is not a string", i+1, iquery)
+				query, vr, err := getQuery(i, iquery)
+				if err != nil {
+					return nil, err
 				}
 				queries = append(queries, query)
+				queryVersions = append(queryVersions, vr)
+				limited = limited || !vr.IsZero()
+			}
+			if !limited {
+				queryVersions = nil
 			}
 
 		case "metrics":
@@ -103,6 +152,51 @@ func getRecipe(prefix, namespace string, specs interface{}) (recipes.MetricQuery
 				return nil, err
 			}
 			resultmaps = rms
+
+		case "interval":
+			var err error
+			interval, err = getDuration(key, ivalue)
+			if err != nil {
+				return nil, err
+			}
+
+		case "timeout":
+			var err error
+			timeout, err = getDuration(key, ivalue)
+			if err != nil {
+				return nil, err
+			}
+
+		case "priority":
+			priority, ok = ivalue.(int)
+			if !ok {
+				return nil, fmt.Errorf("priority %v is not an integer", ivalue)
+			}
+
+		case "parallel":
+			parallel, ok = ivalue.(int)
+			if !ok || parallel < 1 {
+				return nil, fmt.Errorf("parallel %v is not a positive integer", ivalue)
+			}
+
+		case "when":
+			var err error
+			if when, err = getCondition(ivalue); err != nil {
+				return nil, err
+			}
+
+		case "min_version":
+			var err error
+			if versions.Min, err = getVersion(key, ivalue); err != nil {
+				return nil, err
+			}
+
+		case "max_version":
+			var err error
+			if versions.Max, err = getVersion(key, ivalue); err != nil {
+				return nil, err
+			}
+
 		default:
 			return nil, fmt.Errorf("unknown recipe key %v", key)
 
@@ -122,6 +216,18 @@ func getRecipe(prefix, namespace string, specs interface{}) (recipes.MetricQuery
 	if queries == nil {
 		queries = []string{query}
 	}
+	for i, q := range queries {
+		var err error
+		if queries[i], err = ExpandEnv(q); err != nil {
+			return nil, fmt.Errorf("query %d: %v", i+1, err)
+		}
+	}
+	for i, q := range rangeover {
+		var err error
+		if rangeover[i], err = ExpandEnv(q); err != nil {
+			return nil, fmt.Errorf("rangeover: %v", err)
+		}
+	}
 
 	if resultmaps == nil {
 		resultmaps = recipes.MultiResultMap{recipes.NamedResultMap{
@@ -130,10 +236,29 @@ func getRecipe(prefix, namespace string, specs interface{}) (recipes.MetricQuery
 		}}
 	}
 
-	if rangeover != "" {
+	if parallel != 0 && rangeover == nil {
+		return nil, fmt.Errorf("parallel requires rangeover")
+	}
+
+	// Marshalling sorts map keys, so the source doesn't depend on the
+	// order of keys in the file.
+	source, err := yaml.Marshal(specs)
+	if err != nil {
+		return nil, err
+	}
+
+	if rangeover != nil {
+		var rangeQueries []*template.Template
+		for i, query := range rangeover {
+			t, err := template.New(namespace + "_rangeover" + strconv.Itoa(i)).Funcs(recipes.TemplateFuncs()).Parse(query)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing template for rangeover query %d: %v", i, err)
+			}
+			rangeQueries = append(rangeQueries, t)
+		}
 		var tmplQueries []*template.Template
 		for i, query := range queries {
-			t, err := template.New(namespace + strconv.Itoa(i)).Parse(query)
+			t, err := template.New(namespace + strconv.Itoa(i)).Funcs(recipes.TemplateFuncs()).Parse(query)
 			if err != nil {
 				return nil, fmt.Errorf("error parsing template for query %d: %v", i, err)
 			}
@@ -143,21 +268,169 @@ func getRecipe(prefix, namespace string, specs interface{}) (recipes.MetricQuery
 			MetricQueryRecipeBase: &recipes.MetricQueryRecipeBase{
 				Namespace:  prefix + "_" + namespace,
 				Resultmaps: resultmaps,
+				Interval:   interval,
+				Timeout:    timeout,
+				Priority:   priority,
+				Versions:   versions,
+				When:       when,
+				Source:     string(source),
 			},
-			Rangequery: rangeover,
-			Queries:    tmplQueries,
+			Rangequeries:  rangeQueries,
+			Queries:       tmplQueries,
+			QueryVersions: queryVersions,
+			Parallel:      parallel,
 		}, nil
 	}
 	return &recipes.MetricQueryRecipeSimple{
 		MetricQueryRecipeBase: &recipes.MetricQueryRecipeBase{
 			Namespace:  prefix + "_" + namespace,
 			Resultmaps: resultmaps,
+			Interval:   interval,
+			Timeout:    timeout,
+			Priority:   priority,
+			Versions:   versions,
+			When:       when,
+			Source:     string(source),
 		},
-		Queries: queries,
+		Queries:       queries,
+		QueryVersions: queryVersions,
 	}, nil
 
 }
 
+// getQuery parses item i of a queries list, which is either a string or a
+// map with a query and optionally min_version and max_version.
+func getQuery(i int, iquery interface{}) (string, recipes.VersionRange, error) {
+	var vr recipes.VersionRange
+	if query, ok := iquery.(string); ok {
+		return query, vr, nil
+	}
+	m, ok := iquery.(map[interface{}]interface{})
+	if !ok {
+		return "", vr, fmt.Errorf("query %d (%v) is not a string or map", i+1, iquery)
+	}
+	var query string
+	for ikey, ivalue := range m {
+		var err error
+		switch ikey {
+		case "query":
+			if query, ok = ivalue.(string); !ok {
+				return "", vr, fmt.Errorf("query %d: query %v is not a string", i+1, ivalue)
+			}
+		case "min_version":
+			vr.Min, err = getVersion("min_version", ivalue)
+		case "max_version":
+			vr.Max, err = getVersion("max_version", ivalue)
+		default:
+			err = fmt.Errorf("unknown key %v", ikey)
+		}
+		if err != nil {
+			return "", vr, fmt.Errorf("query %d: %v", i+1, err)
+		}
+	}
+	if query == "" {
+		return "", vr, fmt.Errorf("query %d: no query specified", i+1)
+	}
+	return query, vr, nil
+}
+
+// getRangeover parses the value of a recipe's rangeover key, which is either
+// a query or a list of queries, each iterating over the rows of the previous.
+func getRangeover(ivalue interface{}) ([]string, error) {
+	if query, ok := ivalue.(string); ok {
+		return []string{query}, nil
+	}
+	iqueries, ok := ivalue.([]interface{})
+	if !ok || len(iqueries) == 0 {
+		return nil, fmt.Errorf("rangeover %v is not a string or a list of strings", ivalue)
+	}
+	var queries []string
+	for i, iquery := range iqueries {
+		query, ok := iquery.(string)
+		if !ok {
+			return nil, fmt.Errorf("rangeover query %d (%v) is not a string", i+1, iquery)
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+// getCondition parses the value of a recipe's when key, which is either a
+// query or a map with a query and optionally an interval.
+func getCondition(ivalue interface{}) (*recipes.Condition, error) {
+	cond := &recipes.Condition{Interval: recipes.DefaultConditionInterval}
+	switch value := ivalue.(type) {
+	case string:
+		cond.Query = value
+	case map[interface{}]interface{}:
+		for ikey, ivalue := range value {
+			switch ikey {
+			case "query":
+				query, ok := ivalue.(string)
+				if !ok {
+					return nil, fmt.Errorf("when: query %v is not a string", ivalue)
+				}
+				cond.Query = query
+			case "interval":
+				interval, err := getDuration("interval", ivalue)
+				if err != nil {
+					return nil, fmt.Errorf("when: %v", err)
+				}
+				cond.Interval = interval
+			default:
+				return nil, fmt.Errorf("when: unknown key %v", ikey)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("when %v is not a string or map", ivalue)
+	}
+	if cond.Query == "" {
+		return nil, fmt.Errorf("when: no query specified")
+	}
+	var err error
+	if cond.Query, err = ExpandEnv(cond.Query); err != nil {
+		return nil, fmt.Errorf("when: %v", err)
+	}
+	return cond, nil
+}
+
+// getVersion parses the value of the named recipe key as a server version.
+// Integers are accepted since YAML parses an unquoted 10 as one, but other
+// numbers must be quoted: an unquoted 9.10 would otherwise become 9.1.
+func getVersion(key string, ivalue interface{}) (db.Version, error) {
+	var svalue string
+	switch value := ivalue.(type) {
+	case string:
+		svalue = value
+	case int:
+		svalue = strconv.Itoa(value)
+	default:
+		return nil, fmt.Errorf("%s %v is not a string, quote it", key, ivalue)
+	}
+	v, err := db.ParseVersion(svalue)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	return v, nil
+}
+
+// getDuration parses the value of the named recipe key as a non-negative
+// duration.
+func getDuration(key string, ivalue interface{}) (time.Duration, error) {
+	svalue, ok := ivalue.(string)
+	if !ok {
+		return 0, fmt.Errorf("%s %v is not a string", key, ivalue)
+	}
+	d, err := time.ParseDuration(svalue)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s %q: %v", key, svalue, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("bad %s %q: must not be negative", key, svalue)
+	}
+	return d, nil
+}
+
 func getMetrics(value interface{}) (recipes.ResultMap, error) {
 	imetrics, ok := value.([]interface{})
 	if !ok {
@@ -165,17 +438,95 @@ func getMetrics(value interface{}) (recipes.ResultMap, error) {
 	}
 
 	metric_map := make(recipes.ResultMap)
+	var timestamp string
 	for i, c := range imetrics {
 		var err error
 		metname, cmap, err := getMetric(c)
 		if err != nil {
 			return nil, fmt.Errorf("metric %d (%q) invalid: %v", i+1, metname, err)
 		}
+		if cmap.Usage == common.TIMESTAMP {
+			if timestamp != "" {
+				return nil, fmt.Errorf("metric %d (%q) invalid: TIMESTAMP already given by %q", i+1, metname, timestamp)
+			}
+			timestamp = metname
+		}
 		metric_map[metname] = *cmap
 	}
+	if err := checkHistograms(metric_map); err != nil {
+		return nil, err
+	}
 	return metric_map, nil
 }
 
+// checkHistograms checks that the bucket and sum columns of HISTOGRAM
+// columns aren't used for anything else, and that the labels reserved by
+// histograms and summaries aren't used.
+func checkHistograms(metric_map recipes.ResultMap) error {
+	for name, cmap := range metric_map {
+		var reserved string
+		switch cmap.Usage {
+		case common.HISTOGRAM:
+			reserved = "le"
+		case common.SUMMARY:
+			reserved = "quantile"
+		default:
+			continue
+		}
+		if label, ok := metric_map[reserved]; ok && label.Usage == common.LABEL {
+			return fmt.Errorf("label %q is reserved by %q", reserved, name)
+		}
+		if cmap.Bucket == "" {
+			continue
+		}
+		for _, column := range []string{cmap.Bucket, cmap.Sum} {
+			if other, ok := metric_map[column]; ok && other.Usage != common.DISCARD {
+				return fmt.Errorf("column %q of HISTOGRAM %q may only be declared as DISCARD", column, name)
+			}
+		}
+	}
+	return nil
+}
+
+// getStates parses the states of a STATESET column, which must be distinct
+// ignoring case since they're matched case-insensitively.
+func getStates(value interface{}) ([]string, error) {
+	ivalues, ok := value.([]interface{})
+	if !ok || len(ivalues) == 0 {
+		return nil, fmt.Errorf("states %v is not a non-empty list", value)
+	}
+	states := make([]string, len(ivalues))
+	seen := make(map[string]bool, len(ivalues))
+	for i, ivalue := range ivalues {
+		states[i] = fmt.Sprint(ivalue)
+		key := strings.ToLower(states[i])
+		if seen[key] {
+			return nil, fmt.Errorf("state %q listed more than once", states[i])
+		}
+		seen[key] = true
+	}
+	return states, nil
+}
+
+// getFloats parses the value of the named metric attribute as a strictly
+// increasing list of numbers.
+func getFloats(key string, value interface{}) ([]float64, error) {
+	ivalues, ok := value.([]interface{})
+	if !ok || len(ivalues) == 0 {
+		return nil, fmt.Errorf("%s %v is not a non-empty list", key, value)
+	}
+	values := make([]float64, len(ivalues))
+	for i, ivalue := range ivalues {
+		if values[i], ok = toFloat64(ivalue); !ok {
+			return nil, fmt.Errorf("%s has non-numeric value %v", key, ivalue)
+		}
+		if i > 0 && values[i] <= values[i-1] {
+			return nil, fmt.Errorf("%s are not in increasing order", key)
+		}
+	}
+	return values, nil
+}
+
 func getMetric(imetric interface{}) (string, *common.ColumnMapping, error) {
 	column, ok := imetric.(map[interface{}]interface{})
 	if !ok {
@@ -198,51 +549,169 @@ func getMetric(imetric interface{}) (string, *common.ColumnMapping, error) {
 
 		attrs, ok := a.(map[interface{}]interface{})
 		if !ok {
-			return "", nil, fmt.Errorf("non-map value %v", a)
+			return name, nil, fmt.Errorf("non-map value %v", a)
 		}
 		for iattr_key, iattr_val := range attrs {
 			attr_key, ok := iattr_key.(string)
 			if !ok {
-				return "", nil, fmt.Errorf("non-string attribute key %v", iattr_key)
+				return name, nil, fmt.Errorf("non-string attribute key %v", iattr_key)
+			}
+			switch attr_key {
+			case "mapping":
+				mapping, err := getMapping(iattr_val)
+				if err != nil {
+					return name, nil, err
+				}
+				cmap.Mapping = mapping
+				continue
+			case "default":
+				def, ok := toFloat64(iattr_val)
+				if !ok {
+					return name, nil, fmt.Errorf("non-numeric default %v", iattr_val)
+				}
+				cmap.Default = &def
+				continue
+			case "buckets":
+				buckets, err := getFloats(attr_key, iattr_val)
+				if err != nil {
+					return name, nil, err
+				}
+				cmap.Buckets = buckets
+				continue
+			case "states":
+				states, err := getStates(iattr_val)
+				if err != nil {
+					return name, nil, err
+				}
+				cmap.States = states
+				continue
+			case "quantiles":
+				quantiles, err := getFloats(attr_key, iattr_val)
+				if err != nil {
+					return name, nil, err
+				}
+				for _, q := range quantiles {
+					if q <= 0 || q > 1 {
+						return name, nil, fmt.Errorf("quantile %v is not in (0, 1]", q)
+					}
+				}
+				cmap.Quantiles = quantiles
+				continue
 			}
 			attr_val, ok := iattr_val.(string)
 			if !ok {
-				return "", nil, fmt.Errorf("non-string attribute value %v for key %q", iattr_val, attr_key)
+				return name, nil, fmt.Errorf("non-string attribute value %v for key %q", iattr_val, attr_key)
 			}
 
 			switch attr_key {
 			case "usage":
 				usage, err := common.StringToColumnUsage(attr_val)
 				if err != nil {
-					return "", nil, err
+					return name, nil, err
 				}
 				cmap.Usage = usage
 			case "description":
 				cmap.Description = attr_val
 			case "regexp":
-				// TODO handle bad regular expressions without panic
-				cmap.Regexp = regexp.MustCompile(attr_val)
+				re, err := regexp.Compile(attr_val)
+				if err != nil {
+					return name, nil, fmt.Errorf("bad regexp %q: %v", attr_val, err)
+				}
+				cmap.Regexp = re
 			case "value":
 				cmap.Fixedval = attr_val
+			case "bucket":
+				cmap.Bucket = strings.Replace(attr_val, " ", "_", -1)
+			case "sum":
+				cmap.Sum = strings.Replace(attr_val, " ", "_", -1)
+			case "max_age":
+				d, err := getDuration(attr_key, attr_val)
+				if err != nil {
+					return name, nil, err
+				}
+				cmap.MaxAge = d
+			case "max_future":
+				d, err := getDuration(attr_key, attr_val)
+				if err != nil {
+					return name, nil, err
+				}
+				cmap.MaxFuture = d
+			case "timezone":
+				loc, err := time.LoadLocation(attr_val)
+				if err != nil {
+					return name, nil, fmt.Errorf("bad timezone %q: %v", attr_val, err)
+				}
+				cmap.Location = loc
 			default:
-				return "", nil, fmt.Errorf("unknown key %q", attr_key)
+				return name, nil, fmt.Errorf("unknown key %q", attr_key)
 			}
 		}
 		if cmap.Usage == 0 {
-			return "", nil, fmt.Errorf("no usage specified")
+			return name, nil, fmt.Errorf("no usage specified")
 		}
-		if cmap.Usage != common.DISCARD && cmap.Usage != common.LABEL && len(cmap.Description) == 0 {
-			return "", nil, fmt.Errorf("no description specified for non-DISCARD/LABEL usage")
+		if cmap.Usage != common.DISCARD && cmap.Usage != common.LABEL && cmap.Usage != common.INFO && cmap.Usage != common.TIMESTAMP && len(cmap.Description) == 0 {
+			return name, nil, fmt.Errorf("no description specified for non-DISCARD/LABEL/INFO/TIMESTAMP usage")
 		}
 		if cmap.Usage == common.FIXED && len(cmap.Fixedval) == 0 {
-			return "", nil, fmt.Errorf("no value specified for FIXED usage")
+			return name, nil, fmt.Errorf("no value specified for FIXED usage")
+		}
+		if cmap.Usage != common.MAPPEDMETRIC && (cmap.Mapping != nil || cmap.Default != nil) {
+			return name, nil, fmt.Errorf("mapping and default are only allowed for MAPPEDMETRIC usage")
+		}
+		if cmap.Usage == common.MAPPEDMETRIC && len(cmap.Mapping) == 0 && cmap.Default == nil {
+			return name, nil, fmt.Errorf("mapping or default must be specified for MAPPEDMETRIC usage")
+		}
+		if cmap.Usage == common.HISTOGRAM && (cmap.Buckets == nil) == (cmap.Bucket == "" || cmap.Sum == "") {
+			return name, nil, fmt.Errorf("either buckets, or bucket and sum, must be specified for HISTOGRAM usage")
 		}
+		if cmap.Usage != common.HISTOGRAM && (cmap.Bucket != "" || cmap.Sum != "" || cmap.Buckets != nil) {
+			return name, nil, fmt.Errorf("buckets, bucket and sum are only allowed for HISTOGRAM usage")
+		}
+		if cmap.Usage != common.SUMMARY && cmap.Quantiles != nil {
+			return name, nil, fmt.Errorf("quantiles are only allowed for SUMMARY usage")
+		}
+		if (cmap.Usage == common.STATESET) != (cmap.States != nil) {
+			return name, nil, fmt.Errorf("states must be specified for STATESET usage, and only for it")
+		}
+		if cmap.Usage != common.TIMESTAMP && (cmap.MaxAge != 0 || cmap.MaxFuture != 0 || cmap.Location != nil) {
+			return name, nil, fmt.Errorf("max_age, max_future and timezone are only allowed for TIMESTAMP usage")
+		}
+	}
+	return name, &cmap, nil
+}
 
-		// TODO add support for mappings
-		cmap.Mapping = nil
+// getMapping parses the mapping of a MAPPEDMETRIC column.  Keys are
+// lower-cased so that values can be matched case-insensitively.
+func getMapping(value interface{}) (map[string]float64, error) {
+	imapping, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("mapping %v is not a map", value)
+	}
+	mapping := make(map[string]float64, len(imapping))
+	for ik, iv := range imapping {
+		k := strings.ToLower(fmt.Sprint(ik))
+		if _, dup := mapping[k]; dup {
+			return nil, fmt.Errorf("mapping has more than one value for %q", k)
+		}
+		v, ok := toFloat64(iv)
+		if !ok {
+			return nil, fmt.Errorf("mapping has non-numeric value %v for %q", iv, k)
+		}
+		mapping[k] = v
+	}
+	return mapping, nil
+}
 
+// toFloat64 converts a number parsed from YAML to a float64.
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
 	}
-	return name, &cmap, nil
 }
 
 func getResultSets(ivalue interface{}) (recipes.MultiResultMap, error) {
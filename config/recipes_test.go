@@ -1,20 +1,44 @@
 package config
 
 import (
-	"github.com/ncabatoff/dbms_exporter/db"
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ncabatoff/dbms_exporter/common"
+	"github.com/ncabatoff/dbms_exporter/db"
+	"github.com/ncabatoff/dbms_exporter/recipes"
 )
 
 type mockConn struct {
-	sqls  []string
-	rsets []db.ScannedResultSet
+	sqls    []string
+	rsets   []db.ScannedResultSet
+	version db.Version
+	// results, if set, are returned instead of rsets for the given queries.
+	results map[string][]db.ScannedResultSet
+	// errs, if set, are returned for the given queries.
+	errs map[string]error
 }
 
-func (c *mockConn) Query(q string) ([]db.ScannedResultSet, error) {
+func (c *mockConn) Query(ctx context.Context, q string) ([]db.ScannedResultSet, error) {
 	c.sqls = append(c.sqls, q)
+	if err, ok := c.errs[q]; ok {
+		return nil, err
+	}
+	if rsets, ok := c.results[q]; ok {
+		return rsets, nil
+	}
 	return c.rsets, nil
 }
 
+func (c *mockConn) Version(ctx context.Context) (db.Version, error) {
+	return c.version, nil
+}
+
 func (c *mockConn) Close() error {
 	return nil
 }
@@ -39,6 +63,7 @@ func TestGetRecipesSimple(t *testing.T) {
       - met5:
           usage: MAPPEDMETRIC
           description: desc5
+          mapping: {a: 1}
       - met6:
           usage: DURATION
           description: desc6
@@ -123,7 +148,7 @@ func testGetRecipesSingleResultSet(t *testing.T, recipe, namespace string, colna
 	},
 	}}
 
-	srss, err := r.Run(mc)
+	srss, err := r.Run(context.Background(), mc)
 	if err != nil {
 		t.Fatalf("Run failed: %v", err)
 	}
@@ -140,3 +165,740 @@ func testGetRecipesSingleResultSet(t *testing.T, recipe, namespace string, colna
 		}
 	}
 }
+
+func TestGetRecipesInterval(t *testing.T) {
+	recipe := `
+  recipe1:
+    interval: 1h
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+  recipe2:
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+`
+	rs, err := GetRecipes("test", recipe)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	for _, r := range rs {
+		want := map[string]time.Duration{"test_recipe1": time.Hour, "test_recipe2": 0}[r.GetNamespace()]
+		if got := r.GetInterval(); got != want {
+			t.Errorf("recipe %q has interval %v, want %v", r.GetNamespace(), got, want)
+		}
+	}
+
+	_, err = GetRecipes("test", `
+  recipe1:
+    interval: often
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+`)
+	if err == nil {
+		t.Errorf("expected error for bad interval")
+	}
+}
+
+func TestGetRecipesTimeout(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  recipe1:
+    timeout: 30s
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+  recipe2:
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	for _, r := range rs {
+		want := map[string]time.Duration{"test_recipe1": 30 * time.Second, "test_recipe2": 0}[r.GetNamespace()]
+		if got := r.GetTimeout(); got != want {
+			t.Errorf("recipe %q has timeout %v, want %v", r.GetNamespace(), got, want)
+		}
+	}
+
+	_, err = GetRecipes("test", `
+  recipe1:
+    timeout: -1s
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+`)
+	if err == nil {
+		t.Errorf("expected error for negative timeout")
+	}
+}
+
+func TestGetRecipesMapping(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  recipe1:
+    metrics:
+      - state:
+          usage: MAPPEDMETRIC
+          description: connection state
+          mapping:
+            Active: 1
+            idle: 0.5
+          default: -1
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	cmap := rs[0].GetResultMaps()[0].ResultMap["state"]
+	if cmap.Mapping["active"] != 1 || cmap.Mapping["idle"] != 0.5 || len(cmap.Mapping) != 2 {
+		t.Errorf("got mapping %v, want map[active:1 idle:0.5]", cmap.Mapping)
+	}
+	if cmap.Default == nil || *cmap.Default != -1 {
+		t.Errorf("got default %v, want -1", cmap.Default)
+	}
+
+	for _, bad := range []string{`
+          usage: GAUGE
+          description: mapping without MAPPEDMETRIC
+          mapping: {a: 1}
+`, `
+          usage: MAPPEDMETRIC
+          description: non-numeric value
+          mapping: {a: b}
+`, `
+          usage: MAPPEDMETRIC
+          description: neither mapping nor default
+`} {
+		if _, err := GetRecipes("test", "recipe1:\n  metrics:\n    - state:"+bad); err == nil {
+			t.Errorf("expected error for metric%s", bad)
+		}
+	}
+}
+
+func TestGetRecipesOrder(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  zeta:
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+  alpha:
+    priority: 10
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+  mid:
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	var got []string
+	for _, r := range rs {
+		got = append(got, r.GetNamespace())
+	}
+	if want := []string{"test_zeta", "test_alpha", "test_mid"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recipes in order %v, want file order %v", got, want)
+	}
+	if p := rs[1].GetPriority(); p != 10 {
+		t.Errorf("recipe alpha has priority %d, want 10", p)
+	}
+
+	got = nil
+	for _, r := range recipes.SortByPriority(rs) {
+		got = append(got, r.GetNamespace())
+	}
+	if want := []string{"test_alpha", "test_zeta", "test_mid"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recipes sorted by priority %v, want %v", got, want)
+	}
+}
+
+func TestGetRecipesVersions(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  recipe1:
+    min_version: "9.4"
+    max_version: 11
+    queries:
+      - query: select old
+        max_version: "9.6"
+      - query: select new
+        min_version: 10
+      - select always
+    resultsets:
+      - replication:
+          - met1:
+              usage: GAUGE
+              description: desc1
+      - always:
+          - met2:
+              usage: GAUGE
+              description: desc2
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	r := rs[0]
+
+	for _, tc := range []struct {
+		version string
+		applies bool
+		sqls    []string
+	}{
+		{"9.3.25", false, nil},
+		{"9.6.5", true, []string{"select old", "select always"}},
+		{"11.2", true, []string{"select new", "select always"}},
+		{"12.0", false, nil},
+	} {
+		v, _ := db.ParseVersion(tc.version)
+		mc := &mockConn{version: v, rsets: []db.ScannedResultSet{{}}}
+		applies, err := recipes.Applies(context.Background(), r, mc)
+		if err != nil {
+			t.Fatalf("Applies failed: %v", err)
+		}
+		if applies != tc.applies {
+			t.Errorf("recipe applies to %s is %v, want %v", tc.version, applies, tc.applies)
+		}
+		if !applies {
+			continue
+		}
+		if _, err := r.Run(context.Background(), mc); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if !reflect.DeepEqual(mc.sqls, tc.sqls) {
+			t.Errorf("queries run on %s are %v, want %v", tc.version, mc.sqls, tc.sqls)
+		}
+	}
+
+	for _, bad := range []string{
+		"min_version: 9.6",
+		"max_version: nine",
+		"queries: [{min_version: \"10\"}]",
+		"queries: [{query: select 1, version: \"10\"}]",
+	} {
+		_, err := GetRecipes("test", `
+  recipe1:
+    `+bad+`
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+`)
+		if err == nil {
+			t.Errorf("recipe with %q parsed, want error", bad)
+		}
+	}
+}
+
+func TestGetRecipesCondition(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  replication:
+    when: select pg_is_in_recovery()
+    metrics:
+      - lag:
+          usage: GAUGE
+          description: desc1
+  statements:
+    when:
+      query: select count(*) from pg_extension where extname = 'pg_stat_statements'
+      interval: 1h
+    metrics:
+      - calls:
+          usage: COUNTER
+          description: desc1
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	want := []recipes.Condition{
+		{Query: "select pg_is_in_recovery()", Interval: recipes.DefaultConditionInterval},
+		{Query: "select count(*) from pg_extension where extname = 'pg_stat_statements'", Interval: time.Hour},
+	}
+	for i, r := range rs {
+		if got := r.GetCondition(); got == nil || *got != want[i] {
+			t.Errorf("recipe %s has condition %v, want %v", r.GetNamespace(), got, want[i])
+		}
+	}
+
+	for _, tc := range []struct {
+		value interface{}
+		want  bool
+	}{
+		{true, true},
+		{"t", true},
+		{[]byte("f"), false},
+		{int64(2), true},
+		{int64(0), false},
+		{nil, false},
+	} {
+		mc := &mockConn{rsets: []db.ScannedResultSet{{
+			Colnames: []string{"c"},
+			Rows:     [][]interface{}{{tc.value}},
+		}}}
+		got, err := rs[0].GetCondition().Check(context.Background(), mc)
+		if err != nil {
+			t.Errorf("Check with result %v failed: %v", tc.value, err)
+		} else if got != tc.want {
+			t.Errorf("Check with result %v = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+	if got, err := rs[0].GetCondition().Check(context.Background(), &mockConn{}); err != nil || got {
+		t.Errorf("Check with no rows = %v, %v; want false", got, err)
+	}
+
+	if _, err := GetRecipes("test", `
+  recipe1:
+    when:
+      interval: 1h
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+`); err == nil {
+		t.Errorf("recipe with a when lacking a query parsed, want error")
+	}
+}
+
+func TestGetRecipesNestedRangeover(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  tablesize:
+    rangeover:
+      - select name as db_name, owner from sysdatabases
+      - select name as table_name from {{.db_name}}..sysobjects
+    queries:
+      - select rows from {{.db_name}}..{{.table_name}}
+    metrics:
+      - rows:
+          usage: GAUGE
+          description: desc1
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+
+	tables := func(names ...string) []db.ScannedResultSet {
+		srs := db.ScannedResultSet{Colnames: []string{"table_name"}}
+		for _, name := range names {
+			srs.Rows = append(srs.Rows, []interface{}{name})
+		}
+		return []db.ScannedResultSet{srs}
+	}
+	mc := &mockConn{
+		rsets: []db.ScannedResultSet{{Colnames: []string{"rows"}, Rows: [][]interface{}{{int64(1)}}}},
+		results: map[string][]db.ScannedResultSet{
+			"select name as db_name, owner from sysdatabases": {{
+				Colnames: []string{"db_name", "owner"},
+				Rows:     [][]interface{}{{"db1", "sa"}, {"db2", []byte("bob")}},
+			}},
+			"select name as table_name from db1..sysobjects": tables("t1", "t2"),
+			"select name as table_name from db2..sysobjects": tables("t3"),
+		},
+	}
+	srss, err := rs[0].Run(context.Background(), mc)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	wantSqls := []string{
+		"select name as db_name, owner from sysdatabases",
+		"select name as table_name from db1..sysobjects",
+		"select name as table_name from db2..sysobjects",
+		"select rows from db1..t1",
+		"select rows from db1..t2",
+		"select rows from db2..t3",
+	}
+	if !reflect.DeepEqual(mc.sqls, wantSqls) {
+		t.Errorf("queries run are %v, want %v", mc.sqls, wantSqls)
+	}
+	want := db.ScannedResultSet{
+		Colnames: []string{"rows", "db_name", "owner", "table_name"},
+		Rows: [][]interface{}{
+			{int64(1), "db1", "sa", "t1"},
+			{int64(1), "db1", "sa", "t2"},
+			{int64(1), "db2", "bob", "t3"},
+		},
+		LabelColumns: []string{"db_name", "owner", "table_name"},
+	}
+	if len(srss) != 1 || !reflect.DeepEqual(srss[0], want) {
+		t.Errorf("Run yielded %v, want %v", srss, want)
+	}
+}
+
+func TestGetRecipesRangeoverSingleColumn(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  dbsize:
+    rangeover: select name as db_name from sysdatabases
+    query: sp_spaceused {{.}}
+    metrics:
+      - db_name:
+          usage: LABEL
+      - size:
+          usage: GAUGE
+          description: desc1
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	mc := &mockConn{
+		results: map[string][]db.ScannedResultSet{
+			"select name as db_name from sysdatabases": {{
+				Colnames: []string{"db_name"},
+				Rows:     [][]interface{}{{"db1"}},
+			}},
+		},
+	}
+	if _, err := rs[0].Run(context.Background(), mc); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if want := "sp_spaceused db1"; len(mc.sqls) != 2 || mc.sqls[1] != want {
+		t.Errorf("queries run are %v, want the last to be %q", mc.sqls, want)
+	}
+}
+
+func TestGetRecipesRangeoverErrors(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  dbsize:
+    rangeover: select name as db_name from sysdatabases
+    parallel: 2
+    query: sp_spaceused {{.db_name}}
+    metrics:
+      - size:
+          usage: GAUGE
+          description: desc1
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	dbs := func(names ...string) map[string][]db.ScannedResultSet {
+		srs := db.ScannedResultSet{Colnames: []string{"db_name"}}
+		for _, name := range names {
+			srs.Rows = append(srs.Rows, []interface{}{name})
+		}
+		return map[string][]db.ScannedResultSet{"select name as db_name from sysdatabases": {srs}}
+	}
+	rsets := []db.ScannedResultSet{{Colnames: []string{"size"}, Rows: [][]interface{}{{int64(1)}}}}
+	offline := map[string]error{"sp_spaceused db2": errors.New("database db2 is offline")}
+
+	// An empty range is a success without results.
+	srss, err := rs[0].Run(context.Background(), &mockConn{results: dbs()})
+	if err != nil || len(srss) != 1 || len(srss[0].Rows) != 0 {
+		t.Errorf("Run over empty range = %v, %v; want one empty resultset", srss, err)
+	}
+
+	// A failing item doesn't prevent the others from being reported.
+	srss, err = rs[0].Run(context.Background(), &mockConn{results: dbs("db1", "db2", "db3"), rsets: rsets, errs: offline})
+	ierrs, ok := err.(*recipes.ItemErrors)
+	if !ok || len(ierrs.Errs) != 1 || ierrs.Total != 3 || ierrs.Items[0]["db_name"] != "db2" {
+		t.Fatalf("Run with a failing item returned error %v, want ItemErrors for db2", err)
+	}
+	want := [][]interface{}{{int64(1), "db1"}, {int64(1), "db3"}}
+	if len(srss) != 1 || !reflect.DeepEqual(srss[0].Rows, want) {
+		t.Errorf("Run with a failing item yielded %v, want rows %v", srss, want)
+	}
+
+	// If all items fail, so does the recipe.
+	if _, err := rs[0].Run(context.Background(), &mockConn{results: dbs("db2"), errs: offline}); err == nil {
+		t.Errorf("Run with only failing items succeeded, want error")
+	} else if _, ok := err.(*recipes.ItemErrors); ok {
+		t.Errorf("Run with only failing items returned %v, want the item's error", err)
+	}
+
+	// With parallel, an extra connection is opened and results keep the
+	// order of the range.
+	var opened []*mockConn
+	ctx := recipes.WithConnOpener(context.Background(), func(context.Context) (db.Conn, error) {
+		mc := &mockConn{rsets: rsets}
+		opened = append(opened, mc)
+		return mc, nil
+	})
+	mc := &mockConn{results: dbs("db1", "db2", "db3", "db4"), rsets: rsets}
+	srss, err = rs[0].Run(ctx, mc)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(opened) != 1 {
+		t.Fatalf("Run opened %d extra connections, want 1", len(opened))
+	}
+	if n := len(mc.sqls) - 1 + len(opened[0].sqls); n != 4 {
+		t.Errorf("Run ran %d item queries, want 4", n)
+	}
+	want = [][]interface{}{{int64(1), "db1"}, {int64(1), "db2"}, {int64(1), "db3"}, {int64(1), "db4"}}
+	if !reflect.DeepEqual(srss[0].Rows, want) {
+		t.Errorf("Run yielded rows %v, want %v", srss[0].Rows, want)
+	}
+}
+
+func TestGetRecipesTemplateFuncs(t *testing.T) {
+	os.Setenv("TEST_TEMPLATE_SCHEMA", "stats")
+	defer os.Unsetenv("TEST_TEMPLATE_SCHEMA")
+	rs, err := GetRecipes("test", `
+  tables:
+    rangeover: select name from sysdatabases
+    queries:
+      - select count(*) from {{quoteIdent .}}.{{env "TEST_TEMPLATE_SCHEMA" | quoteIdent}}.t where db = {{quoteLiteral .name}}
+      - select {{quoteLiteral target}}, {{serverVersion | quoteLiteral}}, {{.name | upper | replace "-" "_" | quoteLiteral}}
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	mc := &mockConn{
+		version: db.Version{9, 6, 5},
+		results: map[string][]db.ScannedResultSet{
+			"select name from sysdatabases": {{
+				Colnames: []string{"name"},
+				Rows:     [][]interface{}{{"it's-a db"}},
+			}},
+		},
+	}
+
+	for _, tc := range []struct {
+		driver string
+		want   []string
+	}{
+		{"postgres", []string{
+			`select count(*) from "it's-a db"."stats".t where db = 'it''s-a db'`,
+			`select 'db1', '9.6.5', 'IT''S_A DB'`,
+		}},
+		{"freetds", []string{
+			`select count(*) from [it's-a db].[stats].t where db = 'it''s-a db'`,
+			`select 'db1', '9.6.5', 'IT''S_A DB'`,
+		}},
+	} {
+		mc.sqls = nil
+		ctx := recipes.WithTarget(context.Background(), recipes.Target{Name: "db1", Driver: tc.driver})
+		if _, err := rs[0].Run(ctx, mc); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if len(mc.sqls) != 3 || !reflect.DeepEqual(mc.sqls[1:], tc.want) {
+			t.Errorf("%s queries run are %q, want %q", tc.driver, mc.sqls, tc.want)
+		}
+	}
+
+	if _, err := rs[0].Run(context.Background(), mc); err == nil {
+		t.Errorf("Run without a target succeeded, want quoting error")
+	}
+}
+
+func TestGetRecipesHistogram(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  lockwaits:
+    metrics:
+      - class:
+          usage: LABEL
+      - waits:
+          usage: HISTOGRAM
+          description: lock waits by duration in seconds
+          bucket: upper bound
+          sum: wait_seconds
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	got := rs[0].GetResultMaps()[0].ResultMap["waits"]
+	if got.Usage != common.HISTOGRAM || got.Bucket != "upper_bound" || got.Sum != "wait_seconds" {
+		t.Errorf("HISTOGRAM column parsed as %+v", got)
+	}
+
+	for _, bad := range []string{
+		"{usage: HISTOGRAM, description: d, bucket: le}",
+		"{usage: GAUGE, description: d, bucket: le, sum: s}",
+		"{usage: HISTOGRAM, description: d, bucket: class, sum: s}",
+		"{usage: HISTOGRAM, description: d, bucket: b, sum: s}\n      - le: {usage: LABEL}",
+	} {
+		_, err := GetRecipes("test", `
+  lockwaits:
+    metrics:
+      - class:
+          usage: LABEL
+      - waits: `+bad+`
+`)
+		if err == nil {
+			t.Errorf("recipe with waits %s parsed, want error", bad)
+		}
+	}
+}
+
+func TestGetRecipesObserved(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  activity:
+    metrics:
+      - datname:
+          usage: LABEL
+      - xact_age:
+          usage: HISTOGRAM
+          description: age of open transactions in seconds
+          buckets: [1, 10, 60.5, 600]
+      - query_age:
+          usage: SUMMARY
+          description: age of running queries in seconds
+          quantiles: [0.5, 0.99]
+      - wait_age:
+          usage: SUMMARY
+          description: age of waits in seconds
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	rm := rs[0].GetResultMaps()[0].ResultMap
+	if got, want := rm["xact_age"].Buckets, []float64{1, 10, 60.5, 600}; !reflect.DeepEqual(got, want) {
+		t.Errorf("xact_age buckets are %v, want %v", got, want)
+	}
+	if got, want := rm["query_age"].Quantiles, []float64{0.5, 0.99}; !reflect.DeepEqual(got, want) {
+		t.Errorf("query_age quantiles are %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{
+		"{usage: HISTOGRAM, description: d}",
+		"{usage: HISTOGRAM, description: d, buckets: [1, 10], bucket: b, sum: s}",
+		"{usage: HISTOGRAM, description: d, buckets: [10, 1]}",
+		"{usage: HISTOGRAM, description: d, buckets: []}",
+		"{usage: GAUGE, description: d, buckets: [1]}",
+		"{usage: SUMMARY, description: d, quantiles: [0.5, 1.5]}",
+		"{usage: HISTOGRAM, description: d, quantiles: [0.5]}",
+		"{usage: SUMMARY, description: d}\n      - quantile: {usage: LABEL}",
+	} {
+		_, err := GetRecipes("test", `
+  activity:
+    metrics:
+      - age: `+bad+`
+`)
+		if err == nil {
+			t.Errorf("recipe with age %s parsed, want error", bad)
+		}
+	}
+}
+
+func TestGetRecipesInfo(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  server:
+    query: select @@servername as server_name, @@version as version, 1 as up
+    metrics:
+      - server_name:
+          usage: INFO
+      - version:
+          usage: INFO
+          description: server version string
+      - up:
+          usage: GAUGE
+          description: desc1
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	if got := rs[0].GetResultMaps()[0].ResultMap["server_name"].Usage; got != common.INFO {
+		t.Errorf("server_name has usage %v, want INFO", got)
+	}
+
+	rc := NewRecipeChecker("test", []string{"target"})
+	rc.Check("test.yaml", `
+server:
+  metrics:
+    - target:
+        usage: INFO
+    - version:
+        usage: INFO
+`)
+	errs := rc.Errors()
+	if len(errs) != 1 || !strings.Contains(errs[0].Msg, `label "target" collides`) {
+		t.Errorf("checker errors are %v, want one for label target", errs)
+	}
+}
+
+func TestGetRecipesStateset(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  activity:
+    metrics:
+      - datname:
+          usage: LABEL
+      - state:
+          usage: STATESET
+          description: backend state
+          states: [active, idle, idle in transaction]
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	want := []string{"active", "idle", "idle in transaction"}
+	if got := rs[0].GetResultMaps()[0].ResultMap["state"].States; !reflect.DeepEqual(got, want) {
+		t.Errorf("states are %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{
+		"{usage: STATESET, description: d}",
+		"{usage: STATESET, description: d, states: []}",
+		"{usage: STATESET, description: d, states: [a, A]}",
+		"{usage: GAUGE, description: d, states: [a]}",
+	} {
+		_, err := GetRecipes("test", `
+  activity:
+    metrics:
+      - state: `+bad+`
+`)
+		if err == nil {
+			t.Errorf("recipe with state %s parsed, want error", bad)
+		}
+	}
+}
+
+func TestGetRecipesTimestamp(t *testing.T) {
+	rs, err := GetRecipes("test", `
+  history:
+    metrics:
+      - sample_time:
+          usage: TIMESTAMP
+          max_age: 2h
+      - value:
+          usage: GAUGE
+          description: sampled value
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	cmap := rs[0].GetResultMaps()[0].ResultMap["sample_time"]
+	if cmap.Usage != common.TIMESTAMP || cmap.MaxAge != 2*time.Hour || cmap.MaxFuture != 0 {
+		t.Errorf("sample_time mapping is %+v, want TIMESTAMP with max_age 2h", cmap)
+	}
+
+	for _, bad := range []string{
+		"{usage: TIMESTAMP, max_future: -1m}",
+		"{usage: TIMESTAMP, max_age: soon}",
+		"{usage: GAUGE, description: d, max_age: 1h}",
+		"{usage: TIMESTAMP, timezone: Nowhere/Special}",
+		"{usage: GAUGE, description: d, timezone: UTC}",
+	} {
+		_, err := GetRecipes("test", `
+  history:
+    metrics:
+      - sample_time: `+bad+`
+`)
+		if err == nil {
+			t.Errorf("recipe with sample_time %s parsed, want error", bad)
+		}
+	}
+
+	_, err = GetRecipes("test", `
+  history:
+    metrics:
+      - sample_time:
+          usage: TIMESTAMP
+      - reset_time:
+          usage: TIMESTAMP
+`)
+	if err == nil {
+		t.Errorf("recipe with two TIMESTAMP columns parsed, want error")
+	}
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// passwordCommandTimeout limits how long a password_command may run.
+	passwordCommandTimeout = 10 * time.Second
+	// passwordCommandTTL is how long the output of a password_command is
+	// reused, so that it isn't run for every connection.
+	passwordCommandTTL = time.Minute
+)
+
+var envRefRE = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandEnv replaces ${VAR} references in s with the values of the named
+// environment variables.  Unlike os.ExpandEnv, $VAR without braces is left
+// alone, since $ has other meanings in SQL and DSNs.  It's an error to refer
+// to a variable that isn't set.
+func ExpandEnv(s string) (string, error) {
+	var err error
+	expanded := envRefRE.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+// DSNSource returns the DSN to connect with.  It's called each time a
+// connection is opened, so that changed credentials are picked up without
+// a restart.
+type DSNSource func() (string, error)
+
+// StaticDSN returns a DSNSource that always returns dsn.
+func StaticDSN(dsn string) DSNSource {
+	return func() (string, error) {
+		return dsn, nil
+	}
+}
+
+// EnvDSN returns a DSNSource for the DSN given by the environment variable
+// name, or read from the file named by the variable name_FILE, with ${VAR}
+// references expanded.  It returns nil if neither variable is set.
+func EnvDSN(name string) (DSNSource, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		if os.Getenv(name) != "" {
+			return nil, fmt.Errorf("only one of %s and %s_FILE may be set", name, name)
+		}
+		secret := &FileSecret{Path: path}
+		source := func() (string, error) {
+			dsn, err := secret.Read()
+			if err != nil {
+				return "", err
+			}
+			return ExpandEnv(dsn)
+		}
+		_, err := source()
+		return source, err
+	}
+	if dsn := os.Getenv(name); dsn != "" {
+		dsn, err := ExpandEnv(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return StaticDSN(dsn), nil
+	}
+	return nil, nil
+}
+
+// FileSecret is a secret, such as a password, held in a file.  The file is
+// reread whenever it changes, so that secrets can be rotated.
+type FileSecret struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+// Read returns the content of the file, less any trailing newline.
+func (fs *FileSecret) Read() (string, error) {
+	fi, err := os.Stat(fs.Path)
+	if err != nil {
+		return "", err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fi.ModTime().Equal(fs.modTime) || fi.Size() != fs.size {
+		content, err := ioutil.ReadFile(fs.Path)
+		if err != nil {
+			return "", err
+		}
+		fs.value = strings.TrimRight(string(content), "\r\n")
+		fs.modTime, fs.size = fi.ModTime(), fi.Size()
+	}
+	return fs.value, nil
+}
+
+// runPasswordCommand runs args and returns its output, less any trailing
+// newline.
+func runPasswordCommand(args []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), passwordCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("password_command %q failed: %v", args[0], err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
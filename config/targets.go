@@ -0,0 +1,364 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// ExporterConfig is the top-level exporter configuration, describing the
+// databases to scrape.
+type ExporterConfig struct {
+	// Targets maps target names to the details of how to scrape them.
+	Targets map[string]*Target `yaml:"targets"`
+}
+
+// Target describes a single database to scrape.
+type Target struct {
+	// Driver is the DB driver to use, e.g. postgres, freetds, sybase or odbc.
+	Driver string `yaml:"driver"`
+	// DSN is the full connection string.  If empty, one is built from
+	// the components below.  ${VAR} references to environment variables
+	// are expanded in the DSN and its components.
+	DSN string `yaml:"dsn"`
+	// DSNFile names a file holding the DSN, as an alternative to DSN.
+	DSNFile  string `yaml:"dsn_file"`
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// UserFile and PasswordFile name files holding the user and password,
+	// as alternatives to User and Password.  They're reread whenever they
+	// change.
+	UserFile     string `yaml:"user_file"`
+	PasswordFile string `yaml:"password_file"`
+	// PasswordCommand is a command, and its arguments, whose output is
+	// the password.  It's run when a connection is opened, at most once
+	// every passwordCommandTTL.
+	PasswordCommand []string `yaml:"password_command"`
+	Database        string   `yaml:"database"`
+	// Options are extra driver-specific connection parameters.
+	Options map[string]string `yaml:"options"`
+	// RecipeFiles lists the recipe files to scrape this target with.
+	RecipeFiles []string `yaml:"recipe_files"`
+	// Labels are constant labels added to all metrics of this target.
+	Labels map[string]string `yaml:"labels"`
+
+	secretsMu sync.Mutex
+	secrets   map[string]*FileSecret
+
+	passwordMu      sync.Mutex
+	password        string
+	passwordExpires time.Time
+}
+
+// ReadExporterConfigFile opens the named file and parses it as an
+// ExporterConfig.  Relative recipe file paths are resolved against the
+// directory containing the file.
+func ReadExporterConfigFile(path string) (*ExporterConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return getExporterConfig(string(content), filepath.Dir(path))
+}
+
+// GetExporterConfig parses content as an ExporterConfig and validates it.
+func GetExporterConfig(content string) (*ExporterConfig, error) {
+	return getExporterConfig(content, "")
+}
+
+// getExporterConfig is like GetExporterConfig, but resolves relative file
+// paths against dir if it's not empty.
+func getExporterConfig(content, dir string) (*ExporterConfig, error) {
+	var cfg ExporterConfig
+	if err := yaml.UnmarshalStrict([]byte(content), &cfg); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		abs := func(path string) string {
+			if path != "" && !filepath.IsAbs(path) {
+				return filepath.Join(dir, path)
+			}
+			return path
+		}
+		for _, t := range cfg.Targets {
+			if t == nil {
+				continue
+			}
+			for i, rf := range t.RecipeFiles {
+				t.RecipeFiles[i] = abs(rf)
+			}
+			t.DSNFile = abs(t.DSNFile)
+			t.UserFile = abs(t.UserFile)
+			t.PasswordFile = abs(t.PasswordFile)
+		}
+	}
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("no targets specified")
+	}
+	for name, t := range cfg.Targets {
+		if t == nil {
+			return nil, fmt.Errorf("target %q: empty definition", name)
+		}
+		if t.Driver == "" {
+			return nil, fmt.Errorf("target %q: no driver specified", name)
+		}
+		if len(t.RecipeFiles) == 0 {
+			return nil, fmt.Errorf("target %q: no recipe_files specified", name)
+		}
+		// Secrets aren't resolved until a connection is opened, so that
+		// checking a config doesn't need them.
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("target %q: %v", name, err)
+		}
+		for label := range t.Labels {
+			if !labelNameRE.MatchString(label) || label == "target" {
+				return nil, fmt.Errorf("target %q: invalid label name %q", name, label)
+			}
+		}
+	}
+	return &cfg, nil
+}
+
+// TargetNames returns the sorted names of the configured targets.
+func (ec *ExporterConfig) TargetNames() []string {
+	names := make([]string, 0, len(ec.Targets))
+	for name := range ec.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validate checks that the target's DSN settings are consistent, without
+// reading any secrets.
+func (t *Target) validate() error {
+	if t.DSN != "" || t.DSNFile != "" {
+		if t.DSN != "" && t.DSNFile != "" {
+			return fmt.Errorf("cannot specify both dsn and dsn_file")
+		}
+		if t.Host != "" || t.Port != "" || t.User != "" || t.Password != "" || t.Database != "" || len(t.Options) != 0 ||
+			t.UserFile != "" || t.PasswordFile != "" || len(t.PasswordCommand) != 0 {
+			return fmt.Errorf("cannot specify both dsn and dsn components")
+		}
+		return nil
+	}
+	if t.Host == "" {
+		return fmt.Errorf("neither dsn nor host specified")
+	}
+	switch t.Driver {
+	case "postgres", "freetds", "sybase", "odbc":
+	default:
+		return fmt.Errorf("don't know how to build a DSN for driver %q, use dsn instead", t.Driver)
+	}
+	if t.User != "" && t.UserFile != "" {
+		return fmt.Errorf("cannot specify both user and user_file")
+	}
+	n := 0
+	for _, set := range []bool{t.Password != "", t.PasswordFile != "", len(t.PasswordCommand) != 0} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("only one of password, password_file and password_command may be specified")
+	}
+	return nil
+}
+
+// GetDSN returns the DSN to use to connect to the target, either as given
+// or built from the DSN components in the form expected by the driver.
+// Secret files are reread if they've changed, and the password command, if
+// any, is run unless its output is still cached.
+func (t *Target) GetDSN() (string, error) {
+	if err := t.validate(); err != nil {
+		return "", err
+	}
+	if t.DSN != "" || t.DSNFile != "" {
+		dsn := t.DSN
+		if t.DSNFile != "" {
+			var err error
+			if dsn, err = t.secret(t.DSNFile).Read(); err != nil {
+				return "", err
+			}
+		}
+		return ExpandEnv(dsn)
+	}
+
+	user, password, err := t.credentials()
+	if err != nil {
+		return "", err
+	}
+	// Expand the other components; credentials from files or commands
+	// are used verbatim.
+	var host, port, database string
+	for _, c := range []struct {
+		dst *string
+		src string
+	}{{&host, t.Host}, {&port, t.Port}, {&database, t.Database}} {
+		if *c.dst, err = ExpandEnv(c.src); err != nil {
+			return "", err
+		}
+	}
+	options := make(map[string]string, len(t.Options))
+	for k, v := range t.Options {
+		if options[k], err = ExpandEnv(v); err != nil {
+			return "", err
+		}
+	}
+
+	switch t.Driver {
+	case "postgres":
+		u := url.URL{Scheme: "postgres", Host: host, Path: "/" + database}
+		if port != "" {
+			u.Host = net.JoinHostPort(host, port)
+		}
+		if user != "" {
+			u.User = url.UserPassword(user, password)
+			if password == "" {
+				u.User = url.User(user)
+			}
+		}
+		q := make(url.Values)
+		for k, v := range options {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	case "freetds", "sybase":
+		if port != "" {
+			host = host + ":" + port
+		}
+		// The sybase alias means a Sybase server, which gofreetds only
+		// talks to properly in its Sybase compatibility mode.
+		if _, ok := options["compatibility_mode"]; !ok && t.Driver == "sybase" {
+			options["compatibility_mode"] = "sybase"
+		}
+		return joinDSN([]string{"host", host, "user", user, "pwd", password, "database", database}, options, quoteTdsValue)
+	case "odbc":
+		return joinDSN([]string{"server", host, "port", port, "uid", user, "pwd", password, "database", database}, options, quoteOdbcValue)
+	default:
+		return "", fmt.Errorf("don't know how to build a DSN for driver %q, use dsn instead", t.Driver)
+	}
+}
+
+// credentials returns the user and password to connect with.
+func (t *Target) credentials() (string, string, error) {
+	user, err := ExpandEnv(t.User)
+	if err != nil {
+		return "", "", err
+	}
+	if t.UserFile != "" {
+		if user, err = t.secret(t.UserFile).Read(); err != nil {
+			return "", "", err
+		}
+	}
+
+	var password string
+	switch {
+	case t.PasswordFile != "":
+		password, err = t.secret(t.PasswordFile).Read()
+	case len(t.PasswordCommand) != 0:
+		password, err = t.commandPassword()
+	default:
+		password, err = ExpandEnv(t.Password)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return user, password, nil
+}
+
+// commandPassword returns the output of the password command, running it
+// only if the last output is older than passwordCommandTTL.  Failures aren't
+// cached.
+func (t *Target) commandPassword() (string, error) {
+	t.passwordMu.Lock()
+	defer t.passwordMu.Unlock()
+	if time.Now().Before(t.passwordExpires) {
+		return t.password, nil
+	}
+	password, err := runPasswordCommand(t.PasswordCommand)
+	if err != nil {
+		return "", err
+	}
+	t.password, t.passwordExpires = password, time.Now().Add(passwordCommandTTL)
+	return password, nil
+}
+
+// secret returns the FileSecret for path, creating it on first use.
+func (t *Target) secret(path string) *FileSecret {
+	t.secretsMu.Lock()
+	defer t.secretsMu.Unlock()
+	if t.secrets == nil {
+		t.secrets = make(map[string]*FileSecret)
+	}
+	if t.secrets[path] == nil {
+		t.secrets[path] = &FileSecret{Path: path}
+	}
+	return t.secrets[path]
+}
+
+// joinDSN builds a semicolon-separated key=value DSN from kvs, a list of
+// alternating keys and values, followed by options in key order.  Empty
+// values are omitted.  quote makes a value safe to include, or returns an
+// error if it can't be.
+func joinDSN(kvs []string, options map[string]string, quote func(string) (string, error)) (string, error) {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		kvs = append(kvs, k, options[k])
+	}
+
+	var parts []string
+	for i := 0; i+1 < len(kvs); i += 2 {
+		k, v := kvs[i], kvs[i+1]
+		if v == "" {
+			continue
+		}
+		if strings.ContainsAny(k, ";=") {
+			return "", fmt.Errorf("invalid DSN key %q", k)
+		}
+		// Values aren't quoted in errors since they may be secrets.
+		v, err := quote(v)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", k, err)
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// quoteTdsValue checks that v can be part of a FreeTDS DSN.  gofreetds
+// splits DSNs on semicolons without any escaping, but takes everything after
+// the first = of each part as the value.
+func quoteTdsValue(v string) (string, error) {
+	if strings.Contains(v, ";") {
+		return "", fmt.Errorf("value can't contain ';' with the freetds driver, use dsn instead")
+	}
+	return v, nil
+}
+
+// quoteOdbcValue braces v if it contains characters special to ODBC
+// connection strings, doubling any closing braces.
+func quoteOdbcValue(v string) (string, error) {
+	if strings.ContainsAny(v, ";={}") || strings.TrimSpace(v) != v {
+		return "{" + strings.Replace(v, "}", "}}", -1) + "}", nil
+	}
+	return v, nil
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 )
 
@@ -15,6 +16,10 @@ func openDatabaseSqlConn(driver, dsn string) (dbConn, error) {
 	if err != nil {
 		return nil, err
 	}
+	// A Conn must behave like a single connection, so that recipes that
+	// change connection state (e.g. with USE) see that state in all their
+	// queries.
+	conn.SetMaxOpenConns(1)
 	return &sqlDatabase{conn}, nil
 }
 
@@ -22,9 +27,10 @@ type sqlDatabase struct {
 	*sql.DB
 }
 
-// query implements dbConn.
-func (sdb *sqlDatabase) query(sql string) ([]dbResultSet, error) {
-	rs, err := sdb.DB.Query(sql)
+// query implements dbConn.  Drivers supporting it (e.g. lib/pq) cancel the
+// query on the server when ctx is done.
+func (sdb *sqlDatabase) query(ctx context.Context, sql string) ([]dbResultSet, error) {
+	rs, err := sdb.DB.QueryContext(ctx, sql)
 	if err != nil {
 		return nil, err
 	}
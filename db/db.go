@@ -1,13 +1,16 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/common/log"
 )
@@ -51,7 +54,7 @@ func Register(name string, driver dbDriver) {
 // dbConn is an internal wrapper for things like database/sql.DB
 // and gofreetds.Conn.
 type dbConn interface {
-	query(string) ([]dbResultSet, error)
+	query(context.Context, string) ([]dbResultSet, error)
 	Close() error
 }
 
@@ -63,14 +66,23 @@ type dbResultSet interface {
 	Columns() ([]string, error)
 }
 
+// Conn is a connection to a database.  Queries must stop, and should be
+// cancelled on the server side where the driver allows, once their context
+// is done.
 type Conn interface {
-	Query(string) ([]ScannedResultSet, error)
+	Query(context.Context, string) ([]ScannedResultSet, error)
+	// Version returns the version of the server, determined on first use.
+	Version(context.Context) (Version, error)
 	Close() error
 }
 
 type ScannedResultSet struct {
 	Colnames []string
 	Rows     [][]interface{}
+	// LabelColumns names columns added to the resultset by the exporter,
+	// such as those of a rangeover query, which are to be used as labels
+	// even if the recipe doesn't mention them.
+	LabelColumns []string
 }
 
 func scanResultSet(rs dbResultSet) (*ScannedResultSet, error) {
@@ -112,21 +124,103 @@ func scanResultSets(rss []dbResultSet) ([]ScannedResultSet, error) {
 	return srss, nil
 }
 
+// cancelGrace is how long to wait for a driver to return after the context
+// of a query is done before abandoning the connection.  Drivers that
+// support cancellation normally return well within this time.
+const cancelGrace = 250 * time.Millisecond
+
+// scanConn implements Conn on top of a dbConn.  It acts as a watchdog: if a
+// query doesn't return soon after its context is done, e.g. because the
+// driver ignores the context or is stuck in a C library call, the
+// connection is abandoned.  The query is left to run to completion in the
+// background, after which the underlying connection is closed.
 type scanConn struct {
 	dbConn
+	driver string
+
+	mu        sync.Mutex
+	abandoned bool
+	version   Version
+}
+
+type scanResult struct {
+	srss []ScannedResultSet
+	err  error
 }
 
 // Query implements Conn.
-func (s *scanConn) Query(q string) ([]ScannedResultSet, error) {
-	rss, err := s.dbConn.query(q)
+func (s *scanConn) Query(ctx context.Context, q string) ([]ScannedResultSet, error) {
+	s.mu.Lock()
+	abandoned := s.abandoned
+	s.mu.Unlock()
+	if abandoned {
+		return nil, &AbandonedError{Err: fmt.Errorf("connection already abandoned")}
+	}
+
+	done := make(chan scanResult, 1)
+	go func() {
+		rss, err := s.dbConn.query(ctx, q)
+		if err != nil {
+			done <- scanResult{nil, err}
+			return
+		}
+		srss, err := scanResultSets(rss)
+		done <- scanResult{srss, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.srss, res.err
+	case <-ctx.Done():
+	}
+
+	grace := time.NewTimer(cancelGrace)
+	defer grace.Stop()
+	select {
+	case res := <-done:
+		return res.srss, res.err
+	case <-grace.C:
+	}
+
+	log.Warnf("abandoning connection, query didn't stop after %v: %s", ctx.Err(), q)
+	s.mu.Lock()
+	s.abandoned = true
+	s.mu.Unlock()
+	go func() {
+		<-done
+		s.dbConn.Close()
+	}()
+	return nil, &AbandonedError{Err: ctx.Err()}
+}
+
+// Version implements Conn.
+func (s *scanConn) Version(ctx context.Context) (Version, error) {
+	s.mu.Lock()
+	version := s.version
+	s.mu.Unlock()
+	if version != nil {
+		return version, nil
+	}
+
+	version, err := serverVersion(ctx, s.driver, s)
 	if err != nil {
 		return nil, err
 	}
-	return scanResultSets(rss)
+	log.Debugf("%s server version is %s", s.driver, version)
+	s.mu.Lock()
+	s.version = version
+	s.mu.Unlock()
+	return version, nil
 }
 
 // Close implements Conn.
-func (s scanConn) Close() error {
+func (s *scanConn) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.abandoned {
+		// The abandoned query will close the connection when done.
+		return nil
+	}
 	return s.dbConn.Close()
 }
 
@@ -142,7 +236,7 @@ func Open(driverName, dsn string) (Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &scanConn{dbConn: conn}, nil
+	return &scanConn{dbConn: conn, driver: driverName}, nil
 }
 
 func dbStringToFloat64(s string, re *regexp.Regexp) (float64, bool) {
@@ -218,3 +312,109 @@ func ToString(t interface{}) (string, bool) {
 		return "", false
 	}
 }
+
+// ToLabel converts a database value to a label value.  Prometheus requires
+// label values to be UTF-8, which text in other encodings, such as Latin-1
+// from a Sybase server, needn't be, so each run of invalid bytes is replaced
+// by U+FFFD.
+func ToLabel(t interface{}) (string, bool) {
+	s, ok := ToString(t)
+	if !ok || utf8.ValidString(s) {
+		return s, ok
+	}
+	var b strings.Builder
+	invalid := false
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			if !invalid {
+				b.WriteRune(utf8.RuneError)
+			}
+			invalid = true
+		} else {
+			b.WriteString(s[i : i+size])
+			invalid = false
+		}
+		i += size
+	}
+	return b.String(), true
+}
+
+// ToBool converts a database value to a boolean.  Numbers are true when
+// nonzero; strings such as "t", "true", "on" and "yes" are true, and NULL is
+// false.
+func ToBool(t interface{}) (bool, bool) {
+	switch v := t.(type) {
+	case bool:
+		return v, true
+	case nil:
+		return false, true
+	case []byte:
+		return stringToBool(string(v))
+	case string:
+		return stringToBool(v)
+	default:
+		f, ok := ToFloat64(t, nil)
+		return ok && f != 0, ok
+	}
+}
+
+func stringToBool(s string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "t", "true", "on", "yes", "y":
+		return true, true
+	case "f", "false", "off", "no", "n", "":
+		return false, true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return err == nil && f != 0, err == nil
+}
+
+// timeLayouts are the layouts tried when converting text to a time.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// ToTime converts a database value to a time.  Numbers are taken to be
+// seconds since the epoch, and text without a zone to be in loc.  NULL yields
+// the zero time.
+func ToTime(t interface{}, loc *time.Location) (time.Time, bool) {
+	switch v := t.(type) {
+	case time.Time:
+		return v, true
+	case nil:
+		return time.Time{}, true
+	case []byte:
+		return stringToTime(string(v), loc)
+	case string:
+		return stringToTime(v, loc)
+	default:
+		f, ok := ToFloat64(t, nil)
+		if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+			return time.Time{}, false
+		}
+		return epochToTime(f), true
+	}
+}
+
+func stringToTime(s string, loc *time.Location) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return epochToTime(f), true
+	}
+	for _, layout := range timeLayouts {
+		if ts, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func epochToTime(f float64) time.Time {
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
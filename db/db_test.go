@@ -0,0 +1,62 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToTime(t *testing.T) {
+	want := time.Date(2019, 3, 4, 5, 6, 7, 500000000, time.UTC)
+	for _, in := range []interface{}{
+		want,
+		float64(1551675967.5),
+		"1551675967.5",
+		[]byte("2019-03-04T05:06:07.5Z"),
+		"2019-03-04 05:06:07.5",
+		"2019-03-04 06:06:07.5+01",
+	} {
+		got, ok := ToTime(in, time.UTC)
+		if !ok || !got.Equal(want) {
+			t.Errorf("ToTime(%v) = %v, %v; want %v, true", in, got, ok, want)
+		}
+	}
+
+	// Only text without a zone is taken to be in the given location.
+	loc := time.FixedZone("UTC-2", -2*60*60)
+	for _, in := range []interface{}{
+		want,
+		float64(1551675967.5),
+		"2019-03-04 03:06:07.5",
+		[]byte("2019-03-04T03:06:07.5"),
+		"2019-03-04 06:06:07.5+01",
+	} {
+		got, ok := ToTime(in, loc)
+		if !ok || !got.Equal(want) {
+			t.Errorf("ToTime(%v) in %v = %v, %v; want %v, true", in, loc, got, ok, want)
+		}
+	}
+
+	if got, ok := ToTime(nil, time.UTC); !ok || !got.IsZero() {
+		t.Errorf("ToTime(nil) = %v, %v; want zero time, true", got, ok)
+	}
+	if _, ok := ToTime("yesterday", time.UTC); ok {
+		t.Errorf("ToTime(%q) succeeded, want failure", "yesterday")
+	}
+}
+
+func TestToLabel(t *testing.T) {
+	for in, want := range map[interface{}]string{
+		"plain":             "plain",
+		"caf\xe9":           "caf\ufffd",
+		"\xff\xfeok\xc3":    "\ufffdok\ufffd",
+		"d\xc3\xa9j\xe0 vu": "d\u00e9j\ufffd vu",
+		int64(42):           "42",
+	} {
+		if got, ok := ToLabel(in); !ok || got != want {
+			t.Errorf("ToLabel(%q) = %q, %v; want %q, true", in, got, ok, want)
+		}
+	}
+	if got, ok := ToLabel([]byte("caf\xe9")); !ok || got != "caf\ufffd" {
+		t.Errorf("ToLabel(%q) = %q, %v; want %q, true", "caf\xe9", got, ok, "caf\ufffd")
+	}
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// QueryError is returned by recipes when a query fails.  It records the SQL
+// that was being executed along with the underlying driver error.
+type QueryError struct {
+	Query string
+	Err   error
+}
+
+// Error implements error.
+func (qe *QueryError) Error() string {
+	return fmt.Sprintf("Error running query <%s> on database: %v", qe.Query, qe.Err)
+}
+
+// AbandonedError is returned when a connection had to be abandoned because
+// a query didn't stop once its context was done.
+type AbandonedError struct {
+	Err error
+}
+
+// Error implements error.
+func (ae *AbandonedError) Error() string {
+	return fmt.Sprintf("connection abandoned: %v", ae.Err)
+}
+
+// IsAbandoned returns true if err reports an abandoned connection.
+func IsAbandoned(err error) bool {
+	if qe, ok := err.(*QueryError); ok {
+		err = qe.Err
+	}
+	_, ok := err.(*AbandonedError)
+	return ok
+}
+
+// ErrorKind is a coarse classification of errors, used to label error metrics.
+type ErrorKind string
+
+const (
+	ErrorConnect    ErrorKind = "connect"    // The connection failed or was lost
+	ErrorTimeout    ErrorKind = "timeout"    // The query or connection timed out or was cancelled
+	ErrorPermission ErrorKind = "permission" // Insufficient privileges or failed authentication
+	ErrorSyntax     ErrorKind = "syntax"     // Bad SQL, including references to missing objects
+	ErrorConversion ErrorKind = "conversion" // A value couldn't be converted
+	ErrorOther      ErrorKind = "other"      // Anything else
+)
+
+var (
+	errorClassifiersMu sync.RWMutex
+	errorClassifiers   []func(error) (ErrorKind, bool)
+)
+
+// registerErrorClassifier adds a driver-specific function to classify
+// errors.  It should return false for errors it doesn't recognize.
+func registerErrorClassifier(f func(error) (ErrorKind, bool)) {
+	errorClassifiersMu.Lock()
+	defer errorClassifiersMu.Unlock()
+	errorClassifiers = append(errorClassifiers, f)
+}
+
+// Classify determines what kind of error err is, based on the error codes
+// of the registered drivers.
+func Classify(err error) ErrorKind {
+	if qe, ok := err.(*QueryError); ok {
+		err = qe.Err
+	}
+	if _, ok := err.(*AbandonedError); ok {
+		return ErrorTimeout
+	}
+	switch err {
+	case driver.ErrBadConn, io.EOF, io.ErrUnexpectedEOF:
+		return ErrorConnect
+	case context.DeadlineExceeded, context.Canceled:
+		return ErrorTimeout
+	}
+	if nerr, ok := err.(net.Error); ok {
+		if nerr.Timeout() {
+			return ErrorTimeout
+		}
+		return ErrorConnect
+	}
+
+	errorClassifiersMu.RLock()
+	defer errorClassifiersMu.RUnlock()
+	for _, f := range errorClassifiers {
+		if kind, ok := f(err); ok {
+			return kind
+		}
+	}
+	return ErrorOther
+}
+
+// IsConnectionError returns true if err indicates that the connection it
+// came from is broken and should be reopened, as opposed to e.g. a query
+// that failed due to bad SQL or missing permissions.
+func IsConnectionError(err error) bool {
+	return err != nil && Classify(err) == ErrorConnect
+}
+
+// sqlStateKind classifies SQLSTATE codes, as used by ODBC and PostgreSQL.
+func sqlStateKind(state string) (ErrorKind, bool) {
+	switch state {
+	case "HYT00", "HYT01", "57014":
+		return ErrorTimeout, true
+	case "57P01", "57P02", "57P03":
+		return ErrorConnect, true
+	case "42501":
+		return ErrorPermission, true
+	}
+	if len(state) < 2 {
+		return "", false
+	}
+	switch state[:2] {
+	case "08":
+		return ErrorConnect, true
+	case "28":
+		return ErrorPermission, true
+	case "42":
+		return ErrorSyntax, true
+	case "22":
+		return ErrorConversion, true
+	}
+	return "", false
+}
+
+var tdsMsgRE = regexp.MustCompile(`Msg (\d+), Level \d+`)
+
+// tdsMessageNumbers extracts the message numbers from an error produced by
+// FreeTDS, which reports server and DB-Library messages as
+// "Msg <number>, Level <severity>".
+func tdsMessageNumbers(err error) []int {
+	var nums []int
+	for _, m := range tdsMsgRE.FindAllStringSubmatch(err.Error(), -1) {
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	return nums
+}
+
+// tdsMessageKind classifies Sybase/SQL Server message numbers and FreeTDS
+// DB-Library error numbers.
+func tdsMessageKind(n int) (ErrorKind, bool) {
+	switch n {
+	case 20002, // SYBEFCON: server connection failed
+		20004, // SYBEREAD: read from the server failed
+		20006, // SYBEWRIT: write to the server failed
+		20009, // SYBECONN: unable to connect
+		20017, // SYBESEOF: unexpected EOF from the server
+		20047: // SYBEDDNE: DBPROCESS is dead or not enabled
+		return ErrorConnect, true
+	case 20003: // SYBETIME: server connection timed out
+		return ErrorTimeout, true
+	case 229, // permission denied on object
+		230,   // permission denied on column
+		4002,  // login failed
+		10330: // permission denied on object (Sybase 12.5+)
+		return ErrorPermission, true
+	case 102, // incorrect syntax
+		156,  // incorrect syntax near keyword
+		207,  // invalid column name
+		208,  // object not found
+		2812: // stored procedure not found
+		return ErrorSyntax, true
+	case 241, // conversion from character string to datetime failed
+		245, // conversion of value failed
+		247, // arithmetic overflow during conversion
+		249, // syntax error during explicit conversion
+		257, // implicit conversion not allowed
+		3606: // arithmetic overflow
+		return ErrorConversion, true
+	}
+	return "", false
+}
+
+// classifyTdsError classifies errors whose text contains FreeTDS messages,
+// using the first recognized message number.
+func classifyTdsError(err error) (ErrorKind, bool) {
+	for _, n := range tdsMessageNumbers(err) {
+		if kind, ok := tdsMessageKind(n); ok {
+			return kind, true
+		}
+	}
+	if strings.Contains(err.Error(), "dbopen error") {
+		return ErrorConnect, true
+	}
+	return "", false
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want ErrorKind
+	}{
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrorConnect},
+		{&QueryError{Query: "select 1", Err: context.DeadlineExceeded}, ErrorTimeout},
+		{&QueryError{Query: "select 1", Err: &AbandonedError{Err: context.DeadlineExceeded}}, ErrorTimeout},
+		{errors.New("something else"), ErrorOther},
+	} {
+		if got := Classify(tc.err); got != tc.want {
+			t.Errorf("Classify(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+// hungConn is a dbConn whose queries ignore their context and only return
+// once release is closed.
+type hungConn struct {
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (h *hungConn) query(context.Context, string) ([]dbResultSet, error) {
+	<-h.release
+	return nil, errors.New("released")
+}
+
+func (h *hungConn) Close() error {
+	close(h.closed)
+	return nil
+}
+
+func TestScanConnAbandon(t *testing.T) {
+	h := &hungConn{release: make(chan struct{}), closed: make(chan struct{})}
+	conn := &scanConn{dbConn: h}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := conn.Query(ctx, "select 1")
+	if !IsAbandoned(err) {
+		t.Fatalf("Query of hung conn returned %v, want abandoned error", err)
+	}
+	if _, err := conn.Query(context.Background(), "select 1"); !IsAbandoned(err) {
+		t.Errorf("Query of abandoned conn returned %v, want abandoned error", err)
+	}
+	conn.Close()
+
+	select {
+	case <-h.closed:
+		t.Fatalf("abandoned conn closed while its query was still running")
+	default:
+	}
+	close(h.release)
+	select {
+	case <-h.closed:
+	case <-time.After(time.Second):
+		t.Errorf("abandoned conn not closed once its query returned")
+	}
+}
+
+func TestClassifyTdsError(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want ErrorKind
+	}{
+		{"dbsqlexec failed\nMsg 20006, Level 9\nWrite to the server failed\n", ErrorConnect},
+		{"Msg 20003, Level 6\nAdaptive Server connection timed out\n", ErrorTimeout},
+		{"Msg 10330, Level 14, State 1\nSELECT permission denied on object syslogshold", ErrorPermission},
+		{"Msg 208, Level 16, State 1\nnosuchtable not found.", ErrorSyntax},
+		{"Msg 249, Level 16, State 1\nSyntax error during explicit conversion", ErrorConversion},
+	} {
+		got, ok := classifyTdsError(errors.New(tc.msg))
+		if !ok || got != tc.want {
+			t.Errorf("classifyTdsError(%q) = %q, %v, want %q", tc.msg, got, ok, tc.want)
+		}
+	}
+
+	if _, ok := classifyTdsError(errors.New("no messages here")); ok {
+		t.Errorf("classifyTdsError recognized an error without messages")
+	}
+}
+
+func TestSqlStateKind(t *testing.T) {
+	for state, want := range map[string]ErrorKind{
+		"08006": ErrorConnect,
+		"57P01": ErrorConnect,
+		"57014": ErrorTimeout,
+		"HYT00": ErrorTimeout,
+		"42501": ErrorPermission,
+		"28P01": ErrorPermission,
+		"42P01": ErrorSyntax,
+		"22003": ErrorConversion,
+	} {
+		got, ok := sqlStateKind(state)
+		if !ok || got != want {
+			t.Errorf("sqlStateKind(%q) = %q, %v, want %q", state, got, ok, want)
+		}
+	}
+}
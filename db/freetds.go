@@ -2,12 +2,53 @@
 
 package db
 
+/*
+#cgo LDFLAGS: -lsybdb
+#include <sybfront.h>
+#include <sybdb.h>
+
+int dbmsExporterCheckInterrupt(void *dbproc);
+int dbmsExporterHandleInterrupt(void *dbproc);
+
+static void setInterruptHandler(DBPROCESS *dbproc) {
+	dbsetinterrupt(dbproc, dbmsExporterCheckInterrupt, dbmsExporterHandleInterrupt);
+}
+*/
+import "C"
+
 import (
+	"context"
+	"reflect"
+	"sync"
+	"unsafe"
+
 	"github.com/minus5/gofreetds"
 )
 
+// interrupts maps the DBPROCESS of each connection running a query to the
+// query's context, for the interrupt handler that FreeTDS polls about once
+// a second while waiting for results.
+var (
+	interruptsMu sync.Mutex
+	interrupts   = make(map[unsafe.Pointer]context.Context)
+)
+
+// dbprocField is the index of the unexported DBPROCESS field of
+// freetds.Conn.
+var dbprocField []int
+
 func init() {
+	// Queries couldn't be cancelled without the DBPROCESS, so refuse to
+	// run with a gofreetds that doesn't have it where we expect.
+	f, ok := reflect.TypeOf(freetds.Conn{}).FieldByName("dbproc")
+	if !ok || f.Type.Kind() != reflect.Ptr {
+		panic("gofreetds.Conn has no dbproc pointer field, the interrupt handler in db/freetds.go needs updating for this version of gofreetds")
+	}
+	dbprocField = f.Index
+
 	Register("freetds", &freeTdsDrv{})
+	registerErrorClassifier(classifyTdsError)
+	registerVersionQuery("freetds", "SELECT @@version", parseEmbeddedVersion)
 }
 
 type freeTdsDrv struct{}
@@ -33,9 +74,33 @@ func (fdb *freetdsDatabase) Close() error {
 	return nil
 }
 
-func (fdb *freetdsDatabase) query(sql string) ([]dbResultSet, error) {
+// query implements dbConn.  gofreetds provides no way to interrupt a call in
+// progress, and dbcancel isn't safe to use while another thread is blocked
+// in the same DBPROCESS, so the query is cancelled from FreeTDS' interrupt
+// handler instead, which runs on the querying thread.  scanConn still
+// abandons the connection if the query outlives ctx, and the cancellation
+// completes in the background.
+func (fdb *freetdsDatabase) query(ctx context.Context, sql string) ([]dbResultSet, error) {
+	// The handler is installed on every query since gofreetds replaces the
+	// DBPROCESS when it reconnects.
+	if dbproc := tdsDbproc(fdb.conn); dbproc != nil {
+		C.setInterruptHandler(dbproc)
+		key := unsafe.Pointer(dbproc)
+		interruptsMu.Lock()
+		interrupts[key] = ctx
+		interruptsMu.Unlock()
+		defer func() {
+			interruptsMu.Lock()
+			delete(interrupts, key)
+			interruptsMu.Unlock()
+		}()
+	}
+
 	r, err := fdb.conn.Exec(sql)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 	for len(r) > 0 && len(r[0].Columns) == 0 {
@@ -49,6 +114,16 @@ func (fdb *freetdsDatabase) query(sql string) ([]dbResultSet, error) {
 
 }
 
+// tdsDbproc returns the DBPROCESS of conn, which gofreetds doesn't export,
+// or nil if it has none.
+func tdsDbproc(conn *freetds.Conn) *C.DBPROCESS {
+	v := reflect.ValueOf(conn).Elem().FieldByIndex(dbprocField)
+	if v.IsNil() {
+		return nil
+	}
+	return (*C.DBPROCESS)(unsafe.Pointer(v.Pointer()))
+}
+
 type fdbResultSet struct {
 	*freetds.Result
 }
@@ -0,0 +1,36 @@
+// +build freetds
+
+package db
+
+// Functions exported to C must live apart from C definitions, such as the
+// helper in freetds.go that installs them.
+
+/*
+#include <sybfront.h>
+#include <sybdb.h>
+*/
+import "C"
+
+import "unsafe"
+
+// dbmsExporterCheckInterrupt is the DB_DBCHKINTR_FUNC of our connections: it
+// reports an interrupt once the context of the running query is done.
+//
+//export dbmsExporterCheckInterrupt
+func dbmsExporterCheckInterrupt(dbproc unsafe.Pointer) C.int {
+	interruptsMu.Lock()
+	ctx := interrupts[dbproc]
+	interruptsMu.Unlock()
+	if ctx != nil && ctx.Err() != nil {
+		return C.TRUE
+	}
+	return C.FALSE
+}
+
+// dbmsExporterHandleInterrupt is the DB_DBHNDLINTR_FUNC of our connections:
+// it cancels the query on the server.
+//
+//export dbmsExporterHandleInterrupt
+func dbmsExporterHandleInterrupt(dbproc unsafe.Pointer) C.int {
+	return C.INT_CANCEL
+}
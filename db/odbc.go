@@ -2,10 +2,31 @@
 
 package db
 
-import _ "github.com/alexbrainman/odbc"
+import "github.com/alexbrainman/odbc"
 
 func init() {
 	name := "odbc"
 	drv := dsqlDrv(name)
 	Register(name, &drv)
+	registerErrorClassifier(classifyOdbcError)
+	registerVersionQuery(name, "SELECT @@version", parseEmbeddedVersion)
+}
+
+// classifyOdbcError classifies ODBC errors by the SQLSTATE of their
+// diagnostic records, falling back on the native error numbers, which for
+// Sybase via FreeTDS are the same message numbers the freetds driver sees.
+func classifyOdbcError(err error) (ErrorKind, bool) {
+	oerr, ok := err.(*odbc.Error)
+	if !ok {
+		return "", false
+	}
+	for _, diag := range oerr.Diag {
+		if kind, ok := tdsMessageKind(diag.NativeError); ok {
+			return kind, true
+		}
+		if kind, ok := sqlStateKind(diag.State); ok {
+			return kind, true
+		}
+	}
+	return "", false
 }
@@ -2,10 +2,21 @@
 
 package db
 
-import _ "github.com/lib/pq"
+import "github.com/lib/pq"
 
 func init() {
 	name := "postgres"
 	drv := dsqlDrv(name)
 	Register(name, &drv)
+	registerErrorClassifier(classifyPqError)
+	registerVersionQuery(name, "SHOW server_version_num", parsePgVersionNum)
+}
+
+// classifyPqError classifies lib/pq errors by their SQLSTATE code.
+func classifyPqError(err error) (ErrorKind, bool) {
+	pqerr, ok := err.(*pq.Error)
+	if !ok {
+		return "", false
+	}
+	return sqlStateKind(string(pqerr.Code))
 }
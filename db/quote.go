@@ -0,0 +1,75 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// quoting is how to quote identifiers and string literals in the SQL
+// dialect spoken by a driver.
+type quoting struct {
+	ident, literal func(string) string
+}
+
+// quotings maps driver names to their quoting.  Quoting needs nothing from
+// the driver libraries, so all drivers are listed whether or not they're part
+// of the build.  ODBC is assumed to be used with Sybase.
+var quotings = map[string]quoting{
+	"postgres": {quotePgIdent, quotePgLiteral},
+	"freetds":  {quoteTdsIdent, quoteTdsLiteral},
+	"odbc":     {quoteTdsIdent, quoteTdsLiteral},
+}
+
+func getQuoting(driver string) (quoting, error) {
+	q, ok := quotings[driver]
+	if !ok {
+		return quoting{}, fmt.Errorf("don't know how to quote SQL for driver %q", driver)
+	}
+	return q, nil
+}
+
+// QuoteIdent quotes s for use as an identifier, e.g. a database or table
+// name, in SQL sent over connections of the named driver.
+func QuoteIdent(driver, s string) (string, error) {
+	q, err := getQuoting(driver)
+	if err != nil {
+		return "", err
+	}
+	return q.ident(s), nil
+}
+
+// QuoteLiteral quotes s for use as a string literal in SQL sent over
+// connections of the named driver.
+func QuoteLiteral(driver, s string) (string, error) {
+	q, err := getQuoting(driver)
+	if err != nil {
+		return "", err
+	}
+	return q.literal(s), nil
+}
+
+// quotePgIdent quotes a PostgreSQL identifier with double quotes.
+func quotePgIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// quotePgLiteral quotes a PostgreSQL string literal, using the escape string
+// syntax if s contains backslashes so that the result doesn't depend on
+// standard_conforming_strings.
+func quotePgLiteral(s string) string {
+	s = strings.Replace(s, `'`, `''`, -1)
+	if strings.Contains(s, `\`) {
+		return `E'` + strings.Replace(s, `\`, `\\`, -1) + `'`
+	}
+	return `'` + s + `'`
+}
+
+// quoteTdsIdent quotes a Sybase or SQL Server identifier with brackets.
+func quoteTdsIdent(s string) string {
+	return "[" + strings.Replace(s, "]", "]]", -1) + "]"
+}
+
+// quoteTdsLiteral quotes a Sybase or SQL Server string literal.
+func quoteTdsLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
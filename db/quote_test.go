@@ -0,0 +1,27 @@
+package db
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	for _, tc := range []struct {
+		quote func(string) string
+		in    string
+		want  string
+	}{
+		{quotePgIdent, "my db", `"my db"`},
+		{quotePgIdent, `a"b`, `"a""b"`},
+		{quotePgLiteral, "it's", `'it''s'`},
+		{quotePgLiteral, `a\b`, `E'a\\b'`},
+		{quoteTdsIdent, "my db", "[my db]"},
+		{quoteTdsIdent, "a]; drop table x; --", "[a]]; drop table x; --]"},
+		{quoteTdsLiteral, "it's", "'it''s'"},
+	} {
+		if got := tc.quote(tc.in); got != tc.want {
+			t.Errorf("quoting %q gave %s, want %s", tc.in, got, tc.want)
+		}
+	}
+
+	if _, err := QuoteIdent("nosuchdriver", "x"); err == nil {
+		t.Errorf("QuoteIdent with unknown driver succeeded, want error")
+	}
+}
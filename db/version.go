@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	versionQueriesMu sync.RWMutex
+	versionQueries   = make(map[string]versionQuery)
+
+	// versionRE matches the first dotted version number in a string such
+	// as the value of @@version.
+	versionRE = regexp.MustCompile(`\d+(\.\d+)+`)
+)
+
+// versionQuery is how to find the version of the server on the other end of
+// a connection: the query to run, and how to parse the string it returns.
+type versionQuery struct {
+	query string
+	parse func(string) (Version, error)
+}
+
+// registerVersionQuery sets the query used to determine the server version
+// for connections of the named driver.
+func registerVersionQuery(driver, query string, parse func(string) (Version, error)) {
+	versionQueriesMu.Lock()
+	defer versionQueriesMu.Unlock()
+	versionQueries[driver] = versionQuery{query, parse}
+}
+
+// Version is a server version, e.g. 9.6.5 for PostgreSQL or 16.0 for Sybase
+// ASE.
+type Version []int
+
+// ParseVersion parses a dotted version number such as "9.6" or "15.0.3".
+func ParseVersion(s string) (Version, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	v := make(Version, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad version %q", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// String returns v in dotted form.
+func (v Version) String() string {
+	parts := make([]string, len(v))
+	for i, n := range v {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Compare returns -1, 0 or 1 as v is less than, equal to or greater than o.
+// Missing trailing components are taken to be zero.
+func (v Version) Compare(o Version) int {
+	for i := 0; i < len(v) || i < len(o); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(o) {
+			b = o[i]
+		}
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	}
+	return 0
+}
+
+// Truncate returns the first n components of v.
+func (v Version) Truncate(n int) Version {
+	if n < len(v) {
+		return v[:n]
+	}
+	return v
+}
+
+// parseEmbeddedVersion parses the first dotted version number in s, such as
+// "16.0" in "Adaptive Server Enterprise/16.0 SP03 PL02/EBF ...".
+func parseEmbeddedVersion(s string) (Version, error) {
+	m := versionRE.FindString(s)
+	if m == "" {
+		return nil, fmt.Errorf("no version found in %q", s)
+	}
+	return ParseVersion(m)
+}
+
+// parsePgVersionNum parses the value of PostgreSQL's server_version_num,
+// e.g. 90605 for 9.6.5 or 120005 for 12.5.
+func parsePgVersionNum(s string) (Version, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("bad server_version_num %q", s)
+	}
+	if n >= 100000 {
+		return Version{n / 10000, n % 10000}, nil
+	}
+	return Version{n / 10000, n / 100 % 100, n % 100}, nil
+}
+
+// serverVersion runs the version query of the named driver on conn.
+func serverVersion(ctx context.Context, driver string, conn Conn) (Version, error) {
+	versionQueriesMu.RLock()
+	vq, ok := versionQueries[driver]
+	versionQueriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("don't know how to find the server version for driver %q", driver)
+	}
+
+	srss, err := conn.Query(ctx, vq.query)
+	if err != nil {
+		return nil, &QueryError{Query: vq.query, Err: err}
+	}
+	if len(srss) == 0 || len(srss[0].Rows) == 0 || len(srss[0].Rows[0]) == 0 {
+		return nil, fmt.Errorf("version query %q returned no value", vq.query)
+	}
+	s, ok := ToString(srss[0].Rows[0][0])
+	if !ok {
+		return nil, fmt.Errorf("version query %q returned unexpected value %v", vq.query, srss[0].Rows[0][0])
+	}
+	return vq.parse(s)
+}
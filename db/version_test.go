@@ -0,0 +1,48 @@
+package db
+
+import "testing"
+
+func TestParseServerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		parse func(string) (Version, error)
+		in    string
+		want  string
+	}{
+		{parsePgVersionNum, "90605", "9.6.5"},
+		{parsePgVersionNum, "100004", "10.4"},
+		{parsePgVersionNum, "120005", "12.5"},
+		{parseEmbeddedVersion, "Adaptive Server Enterprise/16.0 SP03 PL02/EBF 27413 SMP/P/x86_64", "16.0"},
+		{parseEmbeddedVersion, "Microsoft SQL Server 2017 (RTM) - 14.0.1000.169 (X64)", "14.0.1000.169"},
+	} {
+		got, err := tc.parse(tc.in)
+		if err != nil {
+			t.Errorf("parsing %q: %v", tc.in, err)
+		} else if got.String() != tc.want {
+			t.Errorf("parsing %q gave %s, want %s", tc.in, got, tc.want)
+		}
+	}
+
+	for _, s := range []string{"", "9.x", "-1"} {
+		if v, err := ParseVersion(s); err == nil {
+			t.Errorf("ParseVersion(%q) = %s, want error", s, v)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"9.6", "9.6.0", 0},
+		{"9.6.5", "9.6", 1},
+		{"9.6", "10", -1},
+		{"9.10", "9.9", 1},
+	} {
+		a, _ := ParseVersion(tc.a)
+		b, _ := ParseVersion(tc.b)
+		if got := a.Compare(b); got != tc.want {
+			t.Errorf("%s.Compare(%s) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
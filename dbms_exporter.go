@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"math"
+	"math/rand"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	_ "net/http/pprof"
@@ -22,6 +27,28 @@ import (
 // Version is set at build time use ldflags.
 var Version string
 
+// stringsFlag is a flag.Value collecting the values of a repeatable flag.
+type stringsFlag []string
+
+// String implements flag.Value.
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
+
+// Set implements flag.Value.
+func (sf *stringsFlag) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
+}
+
+// queriesPaths holds the values of -queryfile.
+var queriesPaths stringsFlag
+
+func init() {
+	flag.Var(&queriesPaths, "queryfile",
+		"File with queries to run; may be a directory or a glob, and may be repeated.")
+}
+
 var (
 	version       = flag.Bool("version", false, "print version and exit")
 	listenAddress = flag.String(
@@ -32,9 +59,9 @@ var (
 		"web.telemetry-path", "/metrics",
 		"Path under which to expose metrics.",
 	)
-	queriesPath = flag.String(
-		"queryfile", "",
-		"File with queries to run.",
+	checkConfig = flag.Bool(
+		"config.check", false,
+		"Do not run, check the recipe files and report all problems found, exiting non-zero if there are any.",
 	)
 	onlyDumpMaps = flag.Bool(
 		"dumpmaps", false,
@@ -49,9 +76,46 @@ var (
 		"persistent.connection", false,
 		"keep a DB connection open rather than opening a new one for each scrape",
 	)
+	scrapeTimeout = flag.Duration(
+		"scrape.timeout", 0,
+		"if nonzero, give up on a scrape after this long, abandoning DB connections whose queries can't be interrupted",
+	)
 	queryFatalTimeout = flag.Duration(
 		"scrape.fatal-timeout", 0,
-		"exit if a scrape takes this long to execute",
+		"deprecated alias for -scrape.timeout; the exporter no longer exits on timeout",
+	)
+	scrapeConcurrency = flag.Int(
+		"scrape.concurrency", 1,
+		"number of recipes to run in parallel, each on its own DB connection",
+	)
+	scrapeTimeoutOffset = flag.Duration(
+		"scrape.timeout-offset", 500*time.Millisecond,
+		"time to subtract from the timeout given by Prometheus in the X-Prometheus-Scrape-Timeout-Seconds header, to leave time to respond",
+	)
+	scrapeBudget = flag.Duration(
+		"scrape.budget", 0,
+		"if nonzero, once a scrape has taken this long, skip the remaining (lowest priority) recipes",
+	)
+	scrapeInterval = flag.Duration(
+		"scrape.interval", 0,
+		"if nonzero, scrape in the background this often and serve the last completed scrape rather than scraping on each request",
+	)
+	configFile = flag.String(
+		"config.file", "",
+		"File listing the targets to scrape; if given, -queryfile, -driver and DATA_SOURCE_NAME are ignored.",
+	)
+	probePath = flag.String(
+		"web.probe-path", "/probe",
+		"Path under which to expose metrics of the target named by the target parameter.",
+	)
+	probeTargets = flag.String(
+		"probe.targets", "",
+		"Comma-separated list of target names that may be scraped via the probe path; "+
+			"the DSN for target NAME is read from environment variable DATA_SOURCE_NAME_NAME, or the file named by DATA_SOURCE_NAME_NAME_FILE.",
+	)
+	probeModules = flag.String(
+		"probe.modules", "",
+		"Comma-separated list of module=queryfile pairs selectable via the module parameter of the probe path.",
 	)
 )
 
@@ -80,35 +144,69 @@ type MetricMap struct {
 	desc       *prometheus.Desc                  // Prometheus descriptor
 	conversion func(interface{}) (float64, bool) // Conversion function to turn DB result into float64
 	fixedval   string
+	states     []string // For STATESET columns, the states to emit a series for
+	// unmapped, if not nil, returns true for MAPPEDMETRIC text that has
+	// no value, for which no sample is sent.
+	unmapped func(interface{}) bool
+	// aggregate, if not nil, returns what folds the rows sharing the given
+	// label values into a single metric, e.g. a histogram.
+	aggregate func(labels []string) rowAggregate
 }
 
 // Groups metric maps under a shared set of labels
 type MetricMapNamespace struct {
 	labels         []string             // Label names for this namespace
 	columnMappings map[string]MetricMap // Column mappings in this namespace
+	info           *prometheus.Desc     // The _info metric, if there are INFO columns
+	infoColumns    []string             // INFO columns, in the order of the info labels after labels
+	timestamp      string               // The TIMESTAMP column, if any
+	maxAge         time.Duration        // Oldest timestamp attached to samples
+	maxFuture      time.Duration        // Furthest ahead timestamp attached to samples
+	location       *time.Location       // Time zone of timestamps given as text without one
 }
 
 func makeDescMap(metricName string, resultMap recipes.ResultMap, recipe recipes.MetricQueryRecipe) MetricMapNamespace {
 	thisMap := make(map[string]MetricMap)
 
 	// Get the constant labels
-	var variableLabels []string
+	var variableLabels, infoColumns []string
 	var constLabels = make(prometheus.Labels)
+	mapping := MetricMapNamespace{maxAge: common.DefaultMaxAge, maxFuture: common.DefaultMaxFuture, location: time.Local}
 	for columnName, columnMapping := range resultMap {
 		if columnMapping.Usage == common.LABEL {
 			variableLabels = append(variableLabels, columnName)
 		} else if columnMapping.Usage == common.FIXED {
 			constLabels[columnName] = columnMapping.Fixedval
+		} else if columnMapping.Usage == common.INFO {
+			infoColumns = append(infoColumns, columnName)
+		} else if columnMapping.Usage == common.TIMESTAMP {
+			mapping.timestamp = columnName
+			if columnMapping.MaxAge != 0 {
+				mapping.maxAge = columnMapping.MaxAge
+			}
+			if columnMapping.MaxFuture != 0 {
+				mapping.maxFuture = columnMapping.MaxFuture
+			}
+			if columnMapping.Location != nil {
+				mapping.location = columnMapping.Location
+			}
 		}
 	}
 
+	var info *prometheus.Desc
+	if infoColumns != nil {
+		sort.Strings(infoColumns)
+		info = prometheus.NewDesc(metricName+"_info", fmt.Sprintf("Information from %s, as labels of a metric whose value is always 1", metricName),
+			append(append([]string{}, variableLabels...), infoColumns...), constLabels)
+	}
+
 	newDesc := func(colName, desc string) *prometheus.Desc {
 		return prometheus.NewDesc(fmt.Sprintf("%s_%s", metricName, colName), desc, variableLabels, constLabels)
 	}
 
 	for columnName, columnMapping := range resultMap {
 		switch columnMapping.Usage {
-		case common.DISCARD, common.LABEL:
+		case common.DISCARD, common.LABEL, common.INFO, common.TIMESTAMP:
 			thisMap[columnName] = MetricMap{
 				discard: true,
 			}
@@ -131,22 +229,50 @@ func makeDescMap(metricName string, resultMap recipes.ResultMap, recipe recipes.
 				},
 			}
 		case common.MAPPEDMETRIC:
-			thisMap[columnName] = MetricMap{
+			mapping, def := columnMapping.Mapping, columnMapping.Default
+			mm := MetricMap{
 				vtype: prometheus.GaugeValue,
 				desc:  newDesc(columnName, columnMapping.Description),
 				conversion: func(in interface{}) (float64, bool) {
-					text, ok := in.(string)
+					text, ok := db.ToString(in)
 					if !ok {
 						return math.NaN(), false
 					}
 
-					val, ok := columnMapping.Mapping[text]
+					val, ok := mapping[strings.ToLower(text)]
 					if !ok {
-						return math.NaN(), false
+						return *def, true
 					}
 					return val, true
 				},
 			}
+			if def == nil {
+				mm.unmapped = func(in interface{}) bool {
+					text, ok := db.ToString(in)
+					if !ok {
+						return false
+					}
+					_, ok = mapping[strings.ToLower(text)]
+					return !ok
+				}
+			}
+			thisMap[columnName] = mm
+		case common.STATESET:
+			thisMap[columnName] = MetricMap{
+				vtype: prometheus.GaugeValue,
+				desc: prometheus.NewDesc(fmt.Sprintf("%s_%s", metricName, columnName), columnMapping.Description,
+					append(append([]string{}, variableLabels...), columnName), constLabels),
+				states: columnMapping.States,
+			}
+		case common.HISTOGRAM, common.SUMMARY:
+			thisMap[columnName] = MetricMap{
+				aggregate: newAggregate(newDesc(columnName, columnMapping.Description), columnMapping),
+			}
+			if columnMapping.Bucket != "" {
+				// The bucket and sum columns are consumed by the histogram.
+				thisMap[columnMapping.Bucket] = MetricMap{discard: true}
+				thisMap[columnMapping.Sum] = MetricMap{discard: true}
+			}
 		case common.DURATION:
 			fullName := fmt.Sprintf("%s_milliseconds", columnName)
 			thisMap[columnName] = MetricMap{
@@ -156,7 +282,9 @@ func makeDescMap(metricName string, resultMap recipes.ResultMap, recipe recipes.
 			}
 		}
 	}
-	return MetricMapNamespace{variableLabels, thisMap}
+	mapping.labels, mapping.columnMappings = variableLabels, thisMap
+	mapping.info, mapping.infoColumns = info, infoColumns
+	return mapping
 }
 
 func convertDuration(in interface{}) (float64, bool) {
@@ -206,32 +334,91 @@ func makeDescMaps(recipes []recipes.MetricQueryRecipe) map[string]MetricMapNames
 }
 
 type scrapeRequest struct {
+	ctx     context.Context
 	results chan<- prometheus.Metric
 	done    chan struct{}
 }
 
 // Exporter collects DB metrics. It implements prometheus.Collector.
 type Exporter struct {
-	dsn                  string
+	dsn                  config.DSNSource
 	driver               string
+	target               string
 	persistentConnection bool
-	conn                 db.Conn
-	scrapeChan           chan scrapeRequest
-	duration             prometheus.Gauge
-	totalScrapes         prometheus.Counter
-	errors_total         prometheus.Counter
-	open_seconds_total   prometheus.Counter
-	query_seconds_total  *prometheus.CounterVec
-	metricMap            map[string]MetricMapNamespace
-	recipes              []recipes.MetricQueryRecipe
-	scrapeTimeoutFatal   time.Duration
-}
-
-// NewExporter returns a new exporter for the provided DSN.
-func NewExporter(driver, dsn string, recipes []recipes.MetricQueryRecipe, persistentConn bool, fatalTimeout time.Duration) *Exporter {
+	// openDB opens a DB connection; it's db.Open except in tests.
+	openDB func(driver, dsn string) (db.Conn, error)
+	// conns is the connection pool; each slot is used by a single worker.
+	conns               []db.Conn
+	scrapeChan          chan scrapeRequest
+	duration            prometheus.Gauge
+	totalScrapes        prometheus.Counter
+	up                  prometheus.Gauge
+	errors_total        *prometheus.CounterVec
+	open_seconds_total  prometheus.Counter
+	query_seconds_total *prometheus.CounterVec
+	recipe_success      *prometheus.GaugeVec
+	recipe_last_success *prometheus.GaugeVec
+	cache_age           *prometheus.GaugeVec
+	abandoned_total     prometheus.Counter
+	skipped_total       *prometheus.CounterVec
+	recipe_skipped      *prometheus.GaugeVec
+	cacheMu             sync.Mutex
+	cache               map[string]*recipeCache
+	conditionsMu        sync.Mutex
+	conditions          map[db.Conn]map[string]conditionResult
+	labelMapsMu         sync.Mutex
+	labelMaps           map[string]MetricMapNamespace
+	metricMap           map[string]MetricMapNamespace
+	recipes             []recipes.MetricQueryRecipe
+	scrapeTimeout       time.Duration
+	scrapeInterval      time.Duration
+	scrapeBudget        time.Duration
+
+	// pendingRecipes, if non-nil, replaces recipes at the start of the
+	// next scrape; see SetRecipes.
+	pendingMu      sync.Mutex
+	pendingRecipes []recipes.MetricQueryRecipe
+
+	// Background collection state, used when scrapeInterval is nonzero.
+	snapshotReady   chan struct{}
+	snapshotMu      sync.Mutex
+	snapshot        []prometheus.Metric
+	snapshotTime    time.Time
+	snapshotTsDesc  *prometheus.Desc
+	snapshotAgeDesc *prometheus.Desc
+}
+
+// ExporterOptions holds the settings common to all exporters.
+type ExporterOptions struct {
+	// PersistentConnection keeps the DB connection open between scrapes.
+	PersistentConnection bool
+	// ScrapeTimeout, if nonzero, bounds how long a scrape may take.  DB
+	// connections whose queries don't stop in time are abandoned.
+	ScrapeTimeout time.Duration
+	// ScrapeInterval, if nonzero, makes the exporter scrape in the
+	// background this often, serving the last completed scrape on Collect.
+	ScrapeInterval time.Duration
+	// Budget, if nonzero, is how long a scrape may spend running recipes;
+	// once it's spent the remaining recipes are skipped.
+	Budget time.Duration
+	// Concurrency is the number of recipes to run in parallel, each on
+	// its own connection.  Values below 1 are treated as 1.
+	Concurrency int
+	// Target is the name of the target scraped, made available to query
+	// templates.
+	Target string
+}
+
+// NewExporter returns a new exporter for the DSN provided by dsn.
+func NewExporter(driver string, dsn config.DSNSource, rcps []recipes.MetricQueryRecipe, opts ExporterOptions) *Exporter {
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
 	return &Exporter{
 		driver: driver,
 		dsn:    dsn,
+		openDB: db.Open,
 		duration: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: driver,
 			Subsystem: exporter,
@@ -244,12 +431,17 @@ func NewExporter(driver, dsn string, recipes []recipes.MetricQueryRecipe, persis
 			Name:      "scrapes_total",
 			Help:      "Total number of times the DB was scraped for metrics.",
 		}),
-		errors_total: prometheus.NewCounter(prometheus.CounterOpts{
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: driver,
+			Name:      "up",
+			Help:      "Whether the DB could be reached during the last scrape",
+		}),
+		errors_total: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: driver,
 			Subsystem: exporter,
 			Name:      "scrape_errors_total",
-			Help:      "How many scrapes failed due to an error",
-		}),
+			Help:      "How many errors occurred while scraping, by recipe namespace (empty for connection errors) and kind of error",
+		}, []string{"namespace", "kind"}),
 		open_seconds_total: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: driver,
 			Subsystem: exporter,
@@ -262,11 +454,63 @@ func NewExporter(driver, dsn string, recipes []recipes.MetricQueryRecipe, persis
 			Name:      "query_seconds_total",
 			Help:      "How much time was consumed opening DB connections",
 		}, []string{"namespace"}),
-		metricMap:            makeDescMaps(recipes),
-		recipes:              recipes,
-		persistentConnection: persistentConn,
+		recipe_success: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: driver,
+			Subsystem: exporter,
+			Name:      "recipe_success",
+			Help:      "Whether the last run of the recipe succeeded (1) or failed (0)",
+		}, []string{"namespace"}),
+		recipe_last_success: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: driver,
+			Subsystem: exporter,
+			Name:      "recipe_last_success_timestamp_seconds",
+			Help:      "Unix time at which the recipe last succeeded",
+		}, []string{"namespace"}),
+		cache_age: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: driver,
+			Subsystem: exporter,
+			Name:      "recipe_cache_age_seconds",
+			Help:      "Age of the cached results reported for recipes with an interval",
+		}, []string{"namespace"}),
+		abandoned_total: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: driver,
+			Subsystem: exporter,
+			Name:      "connections_abandoned_total",
+			Help:      "How many DB connections were abandoned because an open or query didn't stop on timeout",
+		}),
+		skipped_total: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: driver,
+			Subsystem: exporter,
+			Name:      "recipes_skipped_total",
+			Help:      "How many times a recipe was skipped because the scrape budget was spent",
+		}, []string{"namespace"}),
+		recipe_skipped: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: driver,
+			Subsystem: exporter,
+			Name:      "recipe_skipped",
+			Help:      "Whether the recipe is currently skipped (1) because of its when condition or the server version",
+		}, []string{"namespace"}),
+		cache:                make(map[string]*recipeCache),
+		conditions:           make(map[db.Conn]map[string]conditionResult),
+		labelMaps:            make(map[string]MetricMapNamespace),
+		metricMap:            makeDescMaps(rcps),
+		recipes:              recipes.SortByPriority(rcps),
+		persistentConnection: opts.PersistentConnection,
+		target:               opts.Target,
+		conns:                make([]db.Conn, concurrency),
 		scrapeChan:           make(chan scrapeRequest),
-		scrapeTimeoutFatal:   fatalTimeout,
+		scrapeTimeout:        opts.ScrapeTimeout,
+		scrapeInterval:       opts.ScrapeInterval,
+		scrapeBudget:         opts.Budget,
+		snapshotReady:        make(chan struct{}),
+		snapshotTsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(driver, exporter, "last_snapshot_timestamp_seconds"),
+			"Unix time at which the background scrape being reported started",
+			nil, nil),
+		snapshotAgeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(driver, exporter, "snapshot_age_seconds"),
+			"How long ago the background scrape being reported started",
+			nil, nil),
 	}
 }
 
@@ -300,45 +544,271 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 
 // Collect implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	req := scrapeRequest{results: ch, done: make(chan struct{})}
-	e.scrapeChan <- req
-	var timeoutChan <-chan time.Time
-	if e.scrapeTimeoutFatal > 0 {
-		t := time.NewTimer(e.scrapeTimeoutFatal)
-		timeoutChan = t.C
+	e.CollectContext(context.Background(), ch)
+}
+
+// CollectContext is like Collect, but the scrape is cut short once ctx is
+// done: queries in progress are cancelled and any recipes not yet run fail.
+func (e *Exporter) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	if e.scrapeInterval > 0 {
+		e.collectSnapshot(ctx, ch)
+		return
 	}
+
+	req := scrapeRequest{ctx: ctx, results: ch, done: make(chan struct{})}
 	select {
-	case <-req.done:
+	case e.scrapeChan <- req:
+	case <-ctx.Done():
+		log.Errorf("Gave up waiting for a scrape of %s database to start: %v", e.driver, ctx.Err())
 		return
-	case <-timeoutChan:
-		log.Fatalf("timed out waiting %s for scrape to complete, exiting", e.scrapeTimeoutFatal)
 	}
+	<-req.done
+}
+
+// collectSnapshot sends the metrics of the last completed background scrape,
+// waiting for the first one if needed.  If ctx is done before the first one
+// completes, the DB is reported down with a timeout error.
+func (e *Exporter) collectSnapshot(ctx context.Context, ch chan<- prometheus.Metric) {
+	select {
+	case <-e.snapshotReady:
+	case <-ctx.Done():
+		log.Errorf("Gave up waiting for the first background scrape of %s database: %v", e.driver, ctx.Err())
+		e.errors_total.WithLabelValues("", string(db.ErrorTimeout)).Inc()
+		ch <- prometheus.MustNewConstMetric(e.up.Desc(), prometheus.GaugeValue, 0)
+		e.errors_total.Collect(ch)
+		return
+	}
+
+	e.snapshotMu.Lock()
+	snapshot, snapshotTime := e.snapshot, e.snapshotTime
+	e.snapshotMu.Unlock()
+
+	for _, m := range snapshot {
+		ch <- m
+	}
+	ch <- prometheus.MustNewConstMetric(e.snapshotTsDesc, prometheus.GaugeValue,
+		float64(snapshotTime.UnixNano())/1e9)
+	ch <- prometheus.MustNewConstMetric(e.snapshotAgeDesc, prometheus.GaugeValue,
+		time.Since(snapshotTime).Seconds())
 }
 
 func (e *Exporter) Start() {
+	if e.scrapeInterval > 0 {
+		go e.scrapeInBackground()
+		return
+	}
+
 	go func() {
 		for req := range e.scrapeChan {
-			ch := req.results
-			e.scrape(ch)
-
-			ch <- e.duration
-			ch <- e.totalScrapes
-			ch <- e.errors_total
-			ch <- e.open_seconds_total
-			e.query_seconds_total.Collect(ch)
+			e.scrapeAndReport(req.ctx, req.results)
 			req.done <- struct{}{}
 		}
 	}()
 }
 
-func (e *Exporter) scrapeRecipe(ch chan<- prometheus.Metric, conn db.Conn, recipe recipes.MetricQueryRecipe) error {
+// scrapeAndReport scrapes the DB and sends the resulting metrics to ch,
+// followed by the exporter's own metrics.
+func (e *Exporter) scrapeAndReport(ctx context.Context, ch chan<- prometheus.Metric) {
+	if e.scrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.scrapeTimeout)
+		defer cancel()
+	}
+	e.scrape(ctx, ch)
+
+	ch <- e.duration
+	ch <- e.totalScrapes
+	ch <- e.up
+	e.errors_total.Collect(ch)
+	ch <- e.open_seconds_total
+	e.query_seconds_total.Collect(ch)
+	e.recipe_success.Collect(ch)
+	e.recipe_last_success.Collect(ch)
+	e.cache_age.Collect(ch)
+	ch <- e.abandoned_total
+	e.skipped_total.Collect(ch)
+	e.recipe_skipped.Collect(ch)
+}
+
+// scrapeInBackground scrapes every scrapeInterval, replacing the snapshot
+// served by Collect each time a scrape completes.
+func (e *Exporter) scrapeInBackground() {
+	ticker := time.NewTicker(e.scrapeInterval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		ch := make(chan prometheus.Metric)
+		done := make(chan []prometheus.Metric)
+		go func() {
+			var metrics []prometheus.Metric
+			for m := range ch {
+				metrics = append(metrics, m)
+			}
+			done <- metrics
+		}()
+		// A background scrape must complete before the next one is due.
+		ctx, cancel := context.WithTimeout(context.Background(), e.scrapeInterval)
+		e.scrapeAndReport(ctx, ch)
+		cancel()
+		close(ch)
+		metrics := <-done
+
+		e.snapshotMu.Lock()
+		first := e.snapshot == nil
+		e.snapshot, e.snapshotTime = metrics, start
+		e.snapshotMu.Unlock()
+		if first {
+			close(e.snapshotReady)
+		}
+
+		<-ticker.C
+	}
+}
+
+// recipeCache holds the results of the last successful run of a recipe that
+// has an interval.
+type recipeCache struct {
+	srss []db.ScannedResultSet
+	// ran is when the results were obtained.
+	ran time.Time
+	// next is when the recipe should be run again.
+	next time.Time
+}
+
+// cachedResults returns the cached results of the recipe if they should be
+// used instead of running it, otherwise nil.
+func (e *Exporter) cachedResults(recipe recipes.MetricQueryRecipe) *recipeCache {
+	e.cacheMu.Lock()
+	defer e.cacheMu.Unlock()
+	cache := e.cache[recipe.GetNamespace()]
+	if recipe.GetInterval() > 0 && cache != nil && time.Now().Before(cache.next) {
+		return cache
+	}
+	return nil
+}
+
+// storeResults caches the results of a run of a recipe with an interval.
+func (e *Exporter) storeResults(recipe recipes.MetricQueryRecipe, srss []db.ScannedResultSet, ran time.Time) *recipeCache {
+	e.cacheMu.Lock()
+	defer e.cacheMu.Unlock()
+	namespace, interval := recipe.GetNamespace(), recipe.GetInterval()
+	next := ran.Add(interval)
+	if e.cache[namespace] == nil {
+		// Spread out the second run of recipes sharing the same
+		// interval, so that they don't all run on the same scrape.
+		next = ran.Add(time.Duration(1 + rand.Int63n(int64(interval))))
+	}
+	cache := &recipeCache{srss: srss, ran: ran, next: next}
+	e.cache[namespace] = cache
+	return cache
+}
+
+// errNotApplicable is returned by scrapeRecipe when the recipe doesn't apply
+// to the server, due to its version or the recipe's when condition.
+var errNotApplicable = errors.New("recipe not applicable to server")
+
+// conditionResult is the result of a recipe's when condition on a
+// connection.
+type conditionResult struct {
+	holds bool
+	// next is when the condition should be checked again.
+	next time.Time
+}
+
+// checkCondition returns whether the when condition of recipe holds on conn,
+// reusing the previous result on conn until it's due to be checked again.
+func (e *Exporter) checkCondition(ctx context.Context, conn db.Conn, recipe recipes.MetricQueryRecipe) (bool, error) {
+	cond := recipe.GetCondition()
+	if cond == nil {
+		return true, nil
+	}
 	namespace := recipe.GetNamespace()
-	log.Debugln("Querying namespace: ", namespace)
-	qstart := time.Now()
-	srss, err := recipe.Run(conn)
-	e.query_seconds_total.WithLabelValues(namespace).Add(time.Since(qstart).Seconds())
+	e.conditionsMu.Lock()
+	result, ok := e.conditions[conn][namespace]
+	e.conditionsMu.Unlock()
+	if ok && time.Now().Before(result.next) {
+		return result.holds, nil
+	}
+
+	holds, err := cond.Check(ctx, conn)
 	if err != nil {
-		return err
+		return false, err
+	}
+	e.conditionsMu.Lock()
+	if e.conditions[conn] == nil {
+		e.conditions[conn] = make(map[string]conditionResult)
+	}
+	e.conditions[conn][namespace] = conditionResult{holds: holds, next: time.Now().Add(cond.Interval)}
+	e.conditionsMu.Unlock()
+	return holds, nil
+}
+
+// recipeApplies returns whether recipe should be run on conn given the server
+// version and the recipe's when condition, and updates recipe_skipped
+// accordingly.
+func (e *Exporter) recipeApplies(ctx context.Context, conn db.Conn, recipe recipes.MetricQueryRecipe) (bool, error) {
+	if recipe.GetCondition() == nil && recipe.GetVersions().IsZero() {
+		return true, nil
+	}
+	applies, err := recipes.Applies(ctx, recipe, conn)
+	if err == nil && applies {
+		applies, err = e.checkCondition(ctx, conn, recipe)
+	}
+	if err != nil {
+		return false, err
+	}
+	skipped := 0.0
+	if !applies {
+		skipped = 1
+	}
+	e.recipe_skipped.WithLabelValues(recipe.GetNamespace()).Set(skipped)
+	return applies, nil
+}
+
+// scrapeRecipe runs the recipe on conn, or uses its cached results, and
+// sends the resulting metrics to ch.  conn may be nil if cache is non-nil.
+// open provides the extra connections of recipes that run items in parallel.
+func (e *Exporter) scrapeRecipe(ctx context.Context, ch chan<- prometheus.Metric, conn db.Conn, recipe recipes.MetricQueryRecipe, cache *recipeCache, open recipes.ConnOpener) error {
+	namespace := recipe.GetNamespace()
+
+	var srss []db.ScannedResultSet
+	if cache != nil {
+		log.Debugf("Using results for namespace %s cached at %s", namespace, cache.ran)
+		srss = cache.srss
+	} else {
+		log.Debugln("Querying namespace: ", namespace)
+		qstart := time.Now()
+		if timeout := recipe.GetTimeout(); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		applies, err := e.recipeApplies(ctx, conn, recipe)
+		if err != nil {
+			return err
+		}
+		if !applies {
+			return errNotApplicable
+		}
+		runCtx := recipes.WithTarget(recipes.WithConnOpener(ctx, open), recipes.Target{Name: e.target, Driver: e.driver})
+		srss, err = recipe.Run(runCtx, conn)
+		e.query_seconds_total.WithLabelValues(namespace).Add(time.Since(qstart).Seconds())
+		if ierrs, ok := err.(*recipes.ItemErrors); ok {
+			// The items that succeeded are still reported.
+			for _, itemErr := range ierrs.Errs {
+				e.errors_total.WithLabelValues(namespace, string(db.Classify(itemErr))).Inc()
+			}
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if recipe.GetInterval() > 0 {
+			cache = e.storeResults(recipe, srss, qstart)
+		}
+	}
+	if cache != nil {
+		e.cache_age.WithLabelValues(namespace).Set(time.Since(cache.ran).Seconds())
 	}
 
 	rms := recipe.GetResultMaps()
@@ -358,19 +828,109 @@ func (e *Exporter) scrapeRecipe(ch chan<- prometheus.Metric, conn db.Conn, recip
 	return nil
 }
 
+// labelDescMap returns the metric map for namespace when the columns extra,
+// which the recipe doesn't mention, are to be used as labels too.
+func (e *Exporter) labelDescMap(namespace string, rm recipes.ResultMap, extra []string) MetricMapNamespace {
+	key := namespace + "\x00" + strings.Join(extra, "\x00")
+	e.labelMapsMu.Lock()
+	defer e.labelMapsMu.Unlock()
+	if mapping, ok := e.labelMaps[key]; ok {
+		return mapping
+	}
+
+	withLabels := make(recipes.ResultMap, len(rm)+len(extra))
+	for columnName, columnMapping := range rm {
+		withLabels[columnName] = columnMapping
+	}
+	for _, columnName := range extra {
+		withLabels[columnName] = common.ColumnMapping{Usage: common.LABEL}
+	}
+	mapping := makeDescMap(namespace, withLabels, nil)
+	e.labelMaps[key] = mapping
+	return mapping
+}
+
+// rowTimestamp returns the time given by the TIMESTAMP column of row, if
+// there is one and it's neither older than maxAge nor further than maxFuture
+// ahead of now.  Timestamps outside those limits are dropped, since
+// Prometheus would reject samples that far out anyway.
+func (e *Exporter) rowTimestamp(namespace string, mapping MetricMapNamespace, row []interface{}, columnIdx map[string]int, now time.Time) (time.Time, bool) {
+	if mapping.timestamp == "" {
+		return time.Time{}, false
+	}
+	idx, ok := columnIdx[mapping.timestamp]
+	if !ok {
+		return time.Time{}, false
+	}
+	ts, ok := db.ToTime(row[idx], mapping.location)
+	if !ok {
+		e.errors_total.WithLabelValues(namespace, string(db.ErrorConversion)).Inc()
+		log.Errorln("Unexpected error parsing column: ", namespace, mapping.timestamp, row[idx])
+		return time.Time{}, false
+	}
+	if ts.IsZero() {
+		return time.Time{}, false
+	}
+	if ts.Before(now.Add(-mapping.maxAge)) || ts.After(now.Add(mapping.maxFuture)) {
+		log.Debugf("dropping timestamp %v of %s in %q: more than %v old or %v ahead", ts, mapping.timestamp, namespace, mapping.maxAge, mapping.maxFuture)
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
 func (e *Exporter) scrapeResultSet(ch chan<- prometheus.Metric, namespace string, srs db.ScannedResultSet, rm recipes.ResultMap) {
 	// Make a lookup map for the column indices
 	var columnIdx = make(map[string]int, len(srs.Colnames))
 	for i, n := range srs.Colnames {
 		columnIdx[n] = i
+		// Recipes refer to columns with spaces replaced by underscores.
+		columnIdx[strings.Replace(n, " ", "_", -1)] = i
 	}
 
+	mapping := e.metricMap[namespace]
+	// Rows with the same info label values yield a single info metric.
+	infoSeen := make(map[string]bool)
+	// Aggregates are emitted once all rows are seen, in order of first
+	// appearance.
+	var aggregates []rowAggregate
+	aggregatesByKey := make(map[string]rowAggregate)
+	var extra []string
+	for _, columnName := range srs.LabelColumns {
+		if _, ok := rm[columnName]; !ok {
+			extra = append(extra, columnName)
+		}
+	}
+	if len(extra) > 0 {
+		mapping = e.labelDescMap(namespace, rm, extra)
+	}
+
+	now := time.Now()
 	for _, row := range srs.Rows {
 		// Get the label values for this row
-		mapping := e.metricMap[namespace]
 		var labels = make([]string, len(mapping.labels))
 		for idx, columnName := range mapping.labels {
-			labels[idx], _ = db.ToString(row[columnIdx[columnName]])
+			labels[idx], _ = db.ToLabel(row[columnIdx[columnName]])
+		}
+
+		// Samples from the row carry its timestamp, if it has a usable one.
+		send := func(m prometheus.Metric) { ch <- m }
+		if ts, ok := e.rowTimestamp(namespace, mapping, row, columnIdx, now); ok {
+			send = func(m prometheus.Metric) { ch <- prometheus.NewMetricWithTimestamp(ts, m) }
+		}
+
+		if mapping.info != nil {
+			infoLabels := append([]string{}, labels...)
+			for _, columnName := range mapping.infoColumns {
+				var value string
+				if i, ok := columnIdx[columnName]; ok {
+					value, _ = db.ToLabel(row[i])
+				}
+				infoLabels = append(infoLabels, value)
+			}
+			if key := strings.Join(infoLabels, "\x00"); !infoSeen[key] {
+				infoSeen[key] = true
+				send(prometheus.MustNewConstMetric(mapping.info, prometheus.GaugeValue, 1, infoLabels...))
+			}
 		}
 
 		// Loop over column names, and match to scan data. Unknown columns
@@ -384,15 +944,51 @@ func (e *Exporter) scrapeResultSet(ch chan<- prometheus.Metric, namespace string
 					continue
 				}
 
+				if metricMapping.aggregate != nil {
+					key := columnName + "\x00" + strings.Join(labels, "\x00")
+					agg := aggregatesByKey[key]
+					if agg == nil {
+						agg = metricMapping.aggregate(labels)
+						aggregatesByKey[key] = agg
+						aggregates = append(aggregates, agg)
+					}
+					if err := agg.add(row, idx, columnIdx); err != nil {
+						e.errors_total.WithLabelValues(namespace, string(db.ErrorConversion)).Inc()
+						log.Errorf("Unexpected error parsing column %s of %s: %v", columnName, namespace, err)
+					}
+					continue
+				}
+
+				if metricMapping.states != nil {
+					text, ok := db.ToString(row[idx])
+					if !ok {
+						e.errors_total.WithLabelValues(namespace, string(db.ErrorConversion)).Inc()
+						log.Errorln("Unexpected error parsing column: ", namespace, columnName, row[idx])
+						continue
+					}
+					for _, state := range metricMapping.states {
+						value := 0.0
+						if strings.EqualFold(text, state) {
+							value = 1
+						}
+						send(prometheus.MustNewConstMetric(metricMapping.desc, metricMapping.vtype, value, append(labels, state)...))
+					}
+					continue
+				}
+
+				if metricMapping.unmapped != nil && metricMapping.unmapped(row[idx]) {
+					log.Debugf("no mapping for %s of %s: %v", columnName, namespace, row[idx])
+					continue
+				}
 				value, ok := metricMapping.conversion(row[idx])
 				if !ok {
-					e.errors_total.Inc()
+					e.errors_total.WithLabelValues(namespace, string(db.ErrorConversion)).Inc()
 					log.Errorln("Unexpected error parsing column: ", namespace, columnName, row[idx])
 					continue
 				}
 
 				// Generate the metric
-				ch <- prometheus.MustNewConstMetric(metricMapping.desc, metricMapping.vtype, value, labels...)
+				send(prometheus.MustNewConstMetric(metricMapping.desc, metricMapping.vtype, value, labels...))
 			} else {
 				log.Debugf("unknown metric %q in namespace %q, labels: %v", columnName, namespace, labels)
 				// Unknown metric. Report as untyped if scan to float64 works, else note an error too.
@@ -406,50 +1002,388 @@ func (e *Exporter) scrapeResultSet(ch chan<- prometheus.Metric, namespace string
 					continue
 				}
 
-				ch <- prometheus.MustNewConstMetric(desc, prometheus.UntypedValue, value)
+				send(prometheus.MustNewConstMetric(desc, prometheus.UntypedValue, value))
 			}
 		}
 	}
+
+	// Aggregates span rows, so they're left without a timestamp.
+	for _, agg := range aggregates {
+		ch <- agg.metric()
+	}
 }
 
-func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
+// scrapeState tracks the outcome of a scrape across workers.
+type scrapeState struct {
+	mu sync.Mutex
+	// roundTrips counts the recipes whose queries got an answer from the
+	// DB, even if it was an error.
+	roundTrips int
+	// opened records which slots of the pool were opened during the scrape.
+	opened []bool
+	// openErr is the first error opening a connection, or using one opened
+	// during the scrape; once set, no more connections are attempted.
+	openErr error
+	// abandoned is set if a connection had to be abandoned.
+	abandoned bool
+	// budgetEnd is when the scrape budget runs out, zero if unlimited.
+	budgetEnd time.Time
+	// slots holds the slots of the pool not in use by a recipe.
+	slots chan int
+}
+
+func (e *Exporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) {
 	defer func(begun time.Time) {
 		e.duration.Set(time.Since(begun).Seconds())
 	}(time.Now())
 
 	e.totalScrapes.Inc()
+	e.swapRecipes()
 
-	conn := e.conn
+	// The DB is considered up only if a query got an answer from it, and
+	// no connection failed or had to be abandoned.
+	st := scrapeState{opened: make([]bool, len(e.conns))}
+	if e.scrapeBudget > 0 {
+		st.budgetEnd = time.Now().Add(e.scrapeBudget)
+	}
 
-	if conn == db.Conn(nil) {
-		start := time.Now()
-		var err error
-		conn, err = db.Open(e.driver, e.dsn)
-		if err != nil {
-			log.Infof("Error opening connection to %s database: %v", e.driver, err)
-			e.errors_total.Inc()
-			return
+	// Each recipe runs on a connection of the pool that's its own until
+	// it's done, so recipes that change connection state (e.g. USE) are
+	// safe.  slots holds the slots of the pool not in use.
+	st.slots = make(chan int, len(e.conns))
+	for slot := range e.conns {
+		st.slots <- slot
+	}
+	work := make(chan recipes.MetricQueryRecipe)
+	var wg sync.WaitGroup
+	for range e.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for recipe := range work {
+				slot := <-st.slots
+				e.scrapeRecipeOnSlot(ctx, ch, slot, recipe, &st)
+				st.slots <- slot
+			}
+		}()
+	}
+	for _, recipe := range e.recipes {
+		work <- recipe
+	}
+	close(work)
+	wg.Wait()
+
+	if st.roundTrips == 0 && st.openErr == nil && !st.abandoned && ctx.Err() == nil {
+		e.ping(ctx, &st)
+	}
+	if !e.persistentConnection {
+		for slot := range e.conns {
+			e.closeConn(slot)
 		}
-		if e.persistentConnection {
-			e.conn = conn
-		} else {
-			defer conn.Close()
+	}
+	up := 0.0
+	if st.roundTrips > 0 && st.openErr == nil && !st.abandoned {
+		up = 1
+	}
+	e.up.Set(up)
+}
+
+// ping checks that the DB answers a trivial query, for scrapes in which no
+// recipe queried it, e.g. because all their results were cached.
+func (e *Exporter) ping(ctx context.Context, st *scrapeState) {
+	if e.ensureConn(ctx, 0, st) != nil {
+		return
+	}
+	_, err := e.conns[0].Query(ctx, "SELECT 1")
+	if err != nil {
+		kind := db.Classify(err)
+		log.Errorf("Error pinging %s database (%s error): %v", e.driver, kind, err)
+		e.errors_total.WithLabelValues("", string(kind)).Inc()
+		if db.IsAbandoned(err) {
+			e.abandoned_total.Inc()
+			st.abandoned = true
+		}
+		if kind == db.ErrorConnect || kind == db.ErrorTimeout {
+			e.closeConn(0)
+			return
 		}
-		e.open_seconds_total.Add(time.Since(start).Seconds())
+	}
+	st.roundTrips++
+}
+
+// SetRecipes replaces the recipes run by the exporter.  The change takes
+// effect at the start of the next scrape, so a scrape in progress always
+// uses a consistent set of recipes.
+func (e *Exporter) SetRecipes(rcps []recipes.MetricQueryRecipe) {
+	if rcps == nil {
+		rcps = []recipes.MetricQueryRecipe{}
+	}
+	e.pendingMu.Lock()
+	e.pendingRecipes = rcps
+	e.pendingMu.Unlock()
+}
+
+// swapRecipes installs the recipes given to SetRecipes, if any.  It must
+// only be called from scrape, before any recipes are run.
+func (e *Exporter) swapRecipes() {
+	e.pendingMu.Lock()
+	rcps := e.pendingRecipes
+	e.pendingRecipes = nil
+	e.pendingMu.Unlock()
+	if rcps == nil {
+		return
 	}
 
+	sources := make(map[string]string, len(e.recipes))
+	for _, recipe := range e.recipes {
+		sources[recipe.GetNamespace()] = recipe.GetSource()
+	}
+	// unchanged holds the recipes whose definition is the same as before.
+	kept, unchanged := make(map[string]bool, len(rcps)), make(map[string]bool, len(rcps))
+	for _, recipe := range rcps {
+		namespace := recipe.GetNamespace()
+		kept[namespace] = true
+		source, ok := sources[namespace]
+		unchanged[namespace] = ok && source != "" && source == recipe.GetSource()
+	}
 	for _, recipe := range e.recipes {
-		err := e.scrapeRecipe(ch, conn, recipe)
+		if namespace := recipe.GetNamespace(); !kept[namespace] {
+			e.recipe_success.DeleteLabelValues(namespace)
+			e.recipe_last_success.DeleteLabelValues(namespace)
+			e.cache_age.DeleteLabelValues(namespace)
+			e.recipe_skipped.DeleteLabelValues(namespace)
+		}
+	}
 
-		if err != nil {
-			log.Errorf("Error running query for %q: %v", recipe.GetNamespace(), err)
-			e.errors_total.Inc()
-			if e.conn != nil {
-				e.conn.Close()
+	// Cached results may not match the new definition of a recipe, but
+	// unchanged recipes keep theirs, and so keep their schedule.
+	e.cacheMu.Lock()
+	for namespace := range e.cache {
+		if !unchanged[namespace] {
+			delete(e.cache, namespace)
+		}
+	}
+	e.cacheMu.Unlock()
+	e.conditionsMu.Lock()
+	for _, results := range e.conditions {
+		for namespace := range results {
+			if !unchanged[namespace] {
+				delete(results, namespace)
 			}
-			e.conn = nil
+		}
+	}
+	e.conditionsMu.Unlock()
+	e.labelMapsMu.Lock()
+	e.labelMaps = make(map[string]MetricMapNamespace)
+	e.labelMapsMu.Unlock()
+
+	e.recipes, e.metricMap = recipes.SortByPriority(rcps), makeDescMaps(rcps)
+	log.Infof("now using %d recipes for %s", len(rcps), e.driver)
+}
+
+// scrapeRecipeOnSlot scrapes recipe using the connection in the given slot
+// of the pool, opening it if needed.
+func (e *Exporter) scrapeRecipeOnSlot(ctx context.Context, ch chan<- prometheus.Metric, slot int, recipe recipes.MetricQueryRecipe, st *scrapeState) {
+	namespace := recipe.GetNamespace()
+	cache := e.cachedResults(recipe)
+	if cache == nil && ctx.Err() != nil {
+		log.Errorf("Skipping %q, scrape deadline exceeded", namespace)
+		e.errors_total.WithLabelValues(namespace, string(db.ErrorTimeout)).Inc()
+		e.recipe_success.WithLabelValues(namespace).Set(0)
+		return
+	}
+	if cache == nil && !st.budgetEnd.IsZero() && time.Now().After(st.budgetEnd) {
+		log.Warnf("Skipping %q, scrape budget of %s spent", namespace, e.scrapeBudget)
+		e.skipped_total.WithLabelValues(namespace).Inc()
+		e.recipe_success.WithLabelValues(namespace).Set(0)
+		return
+	}
+	if cache == nil {
+		if err := e.ensureConn(ctx, slot, st); err != nil {
+			e.recipe_success.WithLabelValues(namespace).Set(0)
+			return
+		}
+	}
+
+	err := e.scrapeRecipe(ctx, ch, e.conns[slot], recipe, cache, func(ctx context.Context) (db.Conn, error) {
+		return e.borrowConn(ctx, st)
+	})
+	if err == errNotApplicable {
+		log.Debugf("Skipping %q, not applicable to this server", namespace)
+		return
+	}
+	if cache == nil {
+		st.mu.Lock()
+		switch kind := db.Classify(err); {
+		case err == nil || (kind != db.ErrorConnect && kind != db.ErrorTimeout):
+			st.roundTrips++
+		case db.IsAbandoned(err):
+			st.abandoned = true
+		case kind == db.ErrorConnect && st.opened[slot] && st.openErr == nil:
+			// Drivers such as lib/pq only dial on the first query, so
+			// a new connection failing this way is as good as a failed
+			// open: don't keep dialing for the remaining recipes.
+			st.openErr = err
+		}
+		st.mu.Unlock()
+	}
+	if err != nil {
+		kind := db.Classify(err)
+		log.Errorf("Error running query for %q (%s error): %v", namespace, kind, err)
+		e.errors_total.WithLabelValues(namespace, string(kind)).Inc()
+		e.recipe_success.WithLabelValues(namespace).Set(0)
+		if db.IsAbandoned(err) {
+			e.abandoned_total.Inc()
+		}
+		// A connection whose query timed out may be in an unknown state
+		// (or, if abandoned, still busy running it), so replace it too.
+		if kind == db.ErrorConnect || kind == db.ErrorTimeout {
+			e.closeConn(slot)
+		}
+		return
+	}
+	e.recipe_success.WithLabelValues(namespace).Set(1)
+	if cache == nil {
+		e.recipe_last_success.WithLabelValues(namespace).Set(float64(time.Now().UnixNano()) / 1e9)
+	}
+}
+
+// ensureConn opens the connection in the given slot of the pool if it isn't
+// open.  Once an open fails, no more are attempted during the scrape.
+func (e *Exporter) ensureConn(ctx context.Context, slot int, st *scrapeState) error {
+	if e.conns[slot] != nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.openErr != nil {
+		return st.openErr
+	}
+	err := e.openConn(ctx, slot)
+	if err != nil {
+		log.Infof("Error opening connection to %s database: %v", e.driver, err)
+		// A failed login is a permission error; errors the drivers
+		// don't recognize count as connect errors.
+		kind := db.Classify(err)
+		if kind == db.ErrorOther {
+			kind = db.ErrorConnect
+		}
+		if db.IsAbandoned(err) {
+			kind = db.ErrorTimeout
+			e.abandoned_total.Inc()
+			st.abandoned = true
+		}
+		e.errors_total.WithLabelValues("", string(kind)).Inc()
+		st.openErr = err
+		return err
+	}
+	st.opened[slot] = true
+	return nil
+}
+
+// borrowConn lends a slot of the pool not in use by any recipe, opening its
+// connection if needed, to a recipe that runs items in parallel.  It returns
+// recipes.ErrNoConns rather than wait if every slot is in use.
+func (e *Exporter) borrowConn(ctx context.Context, st *scrapeState) (db.Conn, error) {
+	var slot int
+	select {
+	case slot = <-st.slots:
+	default:
+		return nil, recipes.ErrNoConns
+	}
+	if err := e.ensureConn(ctx, slot, st); err != nil {
+		st.slots <- slot
+		return nil, err
+	}
+	return &pooledConn{Conn: e.conns[slot], e: e, slot: slot, slots: st.slots}, nil
+}
+
+// pooledConn is a connection of the pool lent to a recipe.  Closing it
+// returns it to the pool, after closing the underlying connection if a query
+// failed in a way that may have left it unusable.
+type pooledConn struct {
+	db.Conn
+	e      *Exporter
+	slot   int
+	slots  chan<- int
+	broken bool
+}
+
+// Query implements db.Conn.
+func (pc *pooledConn) Query(ctx context.Context, q string) ([]db.ScannedResultSet, error) {
+	srss, err := pc.Conn.Query(ctx, q)
+	if kind := db.Classify(err); err != nil && (kind == db.ErrorConnect || kind == db.ErrorTimeout) {
+		pc.broken = true
+	}
+	return srss, err
+}
+
+// Close implements db.Conn.
+func (pc *pooledConn) Close() error {
+	if pc.broken {
+		pc.e.closeConn(pc.slot)
+	}
+	pc.slots <- pc.slot
+	return nil
+}
+
+// openConn opens a new DB connection and stores it in the given slot of
+// the pool.  Drivers can't be interrupted while connecting, so if ctx is
+// done first the attempt is abandoned, and the connection closed whenever
+// it completes.
+func (e *Exporter) openConn(ctx context.Context, slot int) error {
+	conn, err := e.open(ctx)
+	if err != nil {
+		return err
+	}
+	e.conns[slot] = conn
+	return nil
+}
+
+// open opens a new DB connection, giving up on it if ctx is done first.
+func (e *Exporter) open(ctx context.Context) (db.Conn, error) {
+	type openResult struct {
+		conn db.Conn
+		err  error
+	}
+	start := time.Now()
+	done := make(chan openResult, 1)
+	go func() {
+		dsn, err := e.dsn()
+		if err != nil {
+			done <- openResult{nil, fmt.Errorf("error getting DSN: %v", err)}
 			return
 		}
+		conn, err := e.openDB(e.driver, dsn)
+		done <- openResult{conn, err}
+	}()
+
+	var res openResult
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.err == nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, &db.AbandonedError{Err: ctx.Err()}
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	e.open_seconds_total.Add(time.Since(start).Seconds())
+	return res.conn, nil
+}
+
+// closeConn closes the connection in the given slot of the pool, if open.
+func (e *Exporter) closeConn(slot int) {
+	if e.conns[slot] != nil {
+		e.conditionsMu.Lock()
+		delete(e.conditions, e.conns[slot])
+		e.conditionsMu.Unlock()
+		e.conns[slot].Close()
+		e.conns[slot] = nil
 	}
 }
 
@@ -460,49 +1394,132 @@ func main() {
 		fmt.Fprintf(os.Stderr, usage)
 	}
 	flag.Parse()
+	rand.Seed(time.Now().UnixNano())
+	if *queryFatalTimeout != 0 && *scrapeTimeout == 0 {
+		log.Warnf("-scrape.fatal-timeout is deprecated, use -scrape.timeout instead")
+		*scrapeTimeout = *queryFatalTimeout
+	}
 	if *version {
 		fmt.Printf("dbms-exporter version %s\n", Version)
 		os.Exit(0)
 	}
 
-	if *queriesPath == "" {
+	if len(queriesPaths) == 0 && *configFile == "" {
 		log.Fatalf("-queryfile is a required argument")
 	}
 
-	rcps, err := config.ReadRecipesFile(*queriesPath, *driver)
+	modulePaths, err := parseProbeModules(*probeModules)
 	if err != nil {
-		log.Fatalf("error parsing file %q: %v", *queriesPath, err)
+		log.Fatal(err)
+	}
+
+	if *checkConfig {
+		var cfg *config.ExporterConfig
+		if *configFile != "" {
+			cfg, err = config.ReadExporterConfigFile(*configFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+				os.Exit(1)
+			}
+		}
+		if n := checkRecipes(cfg, queriesPaths, *driver, modulePaths); n > 0 {
+			fmt.Fprintf(os.Stderr, "%d problem(s) found\n", n)
+			os.Exit(1)
+		}
+		fmt.Println("recipes OK")
+		return
+	}
+
+	var rcps []recipes.MetricQueryRecipe
+	var targets map[string]ProbeTarget
+	if *configFile != "" {
+		cfg, err := config.ReadExporterConfigFile(*configFile)
+		if err != nil {
+			log.Fatalf("error parsing file %q: %v", *configFile, err)
+		}
+		targets, err = configProbeTargets(cfg)
+		if err != nil {
+			log.Fatalf("error in file %q: %v", *configFile, err)
+		}
+	} else {
+		rcps, err = config.ReadRecipesFiles(queriesPaths, *driver)
+		if err != nil {
+			log.Fatal(err)
+		}
+		targets, err = parseProbeTargets(*probeTargets, *driver, queriesPaths, rcps)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
+
+	// Recipes are read with the driver as given, which sets the prefix
+	// of their metrics.
+	recipeDriver := *driver
 	if *driver == "sybase" {
 		*driver = "freetds"
 	}
-
-	found := false
-	for _, d := range db.Drivers() {
-		if d == *driver {
-			found = true
-			break
+	if *configFile == "" {
+		if err := checkDriver(*driver); err != nil {
+			log.Fatal(err)
 		}
 	}
-	if !found {
-		log.Fatalf("driver %q not supported in this build", *driver)
+	for name, t := range targets {
+		if err := checkDriver(t.Driver); err != nil {
+			log.Fatalf("target %q: %v", name, err)
+		}
 	}
 
 	if *onlyDumpMaps {
-		recipes.DumpMaps(rcps)
+		if *configFile == "" {
+			recipes.DumpMaps(rcps)
+			return
+		}
+		for _, name := range sortedTargetNames(targets) {
+			fmt.Printf("# target %s\n", name)
+			recipes.DumpMaps(targets[name].Recipes)
+		}
 		return
 	}
 
-	dsn := os.Getenv("DATA_SOURCE_NAME")
-	if len(dsn) == 0 {
-		log.Fatal("couldn't find environment variable DATA_SOURCE_NAME")
+	opts := ExporterOptions{
+		PersistentConnection: *persistentConnection,
+		ScrapeTimeout:        *scrapeTimeout,
+		ScrapeInterval:       *scrapeInterval,
+		Budget:               *scrapeBudget,
+		Concurrency:          *scrapeConcurrency,
 	}
+	probeHandler := NewProbeHandler(targets, modulePaths, opts)
+	metricsHandler := &MetricsHandler{}
+	var exporter *Exporter
+	if *configFile != "" {
+		for _, name := range sortedTargetNames(targets) {
+			e, err := probeHandler.Exporter(name, defaultModule)
+			if err != nil {
+				log.Fatalf("target %q: %v", name, err)
+			}
+			metricsHandler.Add(e, targets[name].Labels)
+		}
+	} else {
+		dsn, err := config.EnvDSN("DATA_SOURCE_NAME")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if dsn == nil && len(targets) == 0 {
+			log.Fatal("couldn't find environment variable DATA_SOURCE_NAME or DATA_SOURCE_NAME_FILE")
+		}
 
-	exporter := NewExporter(*driver, dsn, rcps, *persistentConnection, *queryFatalTimeout)
-	exporter.Start()
-	prometheus.MustRegister(exporter)
+		if dsn != nil {
+			exporter = NewExporter(*driver, dsn, rcps, opts)
+			exporter.Start()
+			metricsHandler.Add(exporter, nil)
+		}
+	}
 
-	http.Handle(*metricPath, prometheus.Handler())
+	http.Handle(*metricPath, prometheus.InstrumentHandler("prometheus", metricsHandler))
+	http.Handle(*probePath, probeHandler)
+	reloader := NewReloader(probeHandler, exporter, queriesPaths, recipeDriver)
+	reloader.WatchSignals()
+	http.Handle("/-/reload", reloader)
 	landingPage := []byte(fmt.Sprintf(landingPageFmt, *driver, *driver))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write(landingPage)
@@ -513,7 +1530,11 @@ func main() {
 }
 
 var usage = `
-The DATA_SOURCE_NAME enviroment variable specifies connection details.  Examples:
+The DATA_SOURCE_NAME enviroment variable specifies connection details, or
+DATA_SOURCE_NAME_FILE names a file holding them; ${VAR} references to other
+environment variables are expanded.  It may be omitted if -probe.targets is given, in which case the DSN of each target is
+taken from DATA_SOURCE_NAME_<TARGET> instead, or if -config.file is given, in
+which case the targets and their DSNs come from that file.  Examples:
 
   Sybase FreeTDS example (driver=freetds):
 	compatibility_mode=sybase;user=myuser;pwd=mypassword;server=myhostname
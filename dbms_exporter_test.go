@@ -0,0 +1,763 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/dbms_exporter/config"
+	"github.com/ncabatoff/dbms_exporter/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// collectorFunc is a Collector that describes no metrics.
+type collectorFunc func(ch chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(ch chan<- *prometheus.Desc) {}
+
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
+
+// scrapeRows parses content as a recipe file with a single recipe, feeds a
+// resultset with the given columns and rows through scrapeResultSet using
+// the recipe's first resultmap, and returns the samples gathered in the text
+// exposition format, without comments.
+func scrapeRows(t *testing.T, content string, colnames []string, rows ...[]interface{}) []string {
+	t.Helper()
+	rs, err := config.GetRecipes("test", content)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	e := NewExporter("postgres", nil, rs, ExporterOptions{})
+	namespace, rm := rs[0].GetNamespace(), rs[0].GetResultMaps()[0]
+	if rm.Name != "metrics" {
+		namespace += "_" + rm.Name
+	}
+	srs := db.ScannedResultSet{Colnames: colnames, Rows: rows}
+	return gatherSamples(t, collectorFunc(func(ch chan<- prometheus.Metric) {
+		e.scrapeResultSet(ch, namespace, srs, rm.ResultMap)
+	}))
+}
+
+// gatherSamples collects the metrics of c and returns them in the text
+// exposition format, without comments.
+func gatherSamples(t *testing.T, c prometheus.Collector) []string {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather metrics: %v", err)
+	}
+
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var samples []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			samples = append(samples, line)
+		}
+	}
+	return samples
+}
+
+// stubConn is a db.Conn that answers queries from a fixed set of results.
+type stubConn struct {
+	results map[string][]db.ScannedResultSet
+	errs    map[string]error
+	// err, if set, is returned for all queries.
+	err error
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (c *stubConn) Query(ctx context.Context, q string) ([]db.ScannedResultSet, error) {
+	c.mu.Lock()
+	c.queries = append(c.queries, q)
+	c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if err, ok := c.errs[q]; ok {
+		return nil, err
+	}
+	if srss, ok := c.results[q]; ok {
+		return srss, nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", q)
+}
+
+func (c *stubConn) Version(ctx context.Context) (db.Version, error) {
+	return db.Version{}, nil
+}
+
+func (c *stubConn) Close() error {
+	return nil
+}
+
+// stubExporter returns an exporter running the recipes in content, whose
+// connections are opened by calling open.
+func stubExporter(t *testing.T, content string, opts ExporterOptions, open func() (db.Conn, error)) *Exporter {
+	t.Helper()
+	rs, err := config.GetRecipes("test", content)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	e := NewExporter("postgres", config.StaticDSN("stub"), rs, opts)
+	e.openDB = func(driver, dsn string) (db.Conn, error) {
+		return open()
+	}
+	return e
+}
+
+// scrapeSamples runs a scrape of e and returns the samples whose names
+// start with one of prefixes.
+func scrapeSamples(t *testing.T, e *Exporter, prefixes ...string) []string {
+	t.Helper()
+	var samples []string
+	for _, sample := range gatherSamples(t, collectorFunc(func(ch chan<- prometheus.Metric) {
+		e.scrapeAndReport(context.Background(), ch)
+	})) {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(sample, prefix) {
+				samples = append(samples, sample)
+				break
+			}
+		}
+	}
+	return samples
+}
+
+// checkSamples reports an error unless got equals want.
+func checkSamples(t *testing.T, got, want []string) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+func TestScrapeHistogramBuckets(t *testing.T) {
+	got := scrapeRows(t, `
+  lockwaits:
+    query: SELECT 1
+    metrics:
+      - class:
+          usage: LABEL
+      - waits:
+          usage: HISTOGRAM
+          description: lock waits
+          bucket: upper_bound
+          sum: wait_seconds
+`, []string{"class", "upper_bound", "waits", "wait_seconds"},
+		// Rows needn't be in bucket order, and a NULL bound is +Inf.
+		[]interface{}{"row", 10.0, int64(2), 12.0},
+		[]interface{}{"row", 1.0, int64(3), 1.5},
+		[]interface{}{"row", nil, int64(1), 30.0},
+		[]interface{}{"table", 1.0, int64(4), 2.0},
+	)
+	checkSamples(t, got, []string{
+		`test_lockwaits_waits_bucket{class="row",le="1"} 3`,
+		`test_lockwaits_waits_bucket{class="row",le="10"} 5`,
+		`test_lockwaits_waits_bucket{class="row",le="+Inf"} 6`,
+		`test_lockwaits_waits_sum{class="row"} 43.5`,
+		`test_lockwaits_waits_count{class="row"} 6`,
+		`test_lockwaits_waits_bucket{class="table",le="1"} 4`,
+		`test_lockwaits_waits_bucket{class="table",le="+Inf"} 4`,
+		`test_lockwaits_waits_sum{class="table"} 2`,
+		`test_lockwaits_waits_count{class="table"} 4`,
+	})
+}
+
+func TestScrapeObservedHistogram(t *testing.T) {
+	got := scrapeRows(t, `
+  activity:
+    query: SELECT 1
+    metrics:
+      - datname:
+          usage: LABEL
+      - pid:
+          usage: DISCARD
+      - xact_age:
+          usage: HISTOGRAM
+          description: transaction age
+          buckets: [1, 10, 60, 600, 3600]
+`, []string{"datname", "pid", "xact_age"},
+		[]interface{}{"a", int64(1), 50.0},
+		[]interface{}{"a", int64(2), 0.5},
+		[]interface{}{"a", int64(3), nil},
+		[]interface{}{"a", int64(4), 700.0},
+		[]interface{}{"a", int64(5), 10.0},
+	)
+	checkSamples(t, got, []string{
+		`test_activity_xact_age_bucket{datname="a",le="1"} 1`,
+		`test_activity_xact_age_bucket{datname="a",le="10"} 2`,
+		`test_activity_xact_age_bucket{datname="a",le="60"} 3`,
+		`test_activity_xact_age_bucket{datname="a",le="600"} 3`,
+		`test_activity_xact_age_bucket{datname="a",le="3600"} 4`,
+		`test_activity_xact_age_bucket{datname="a",le="+Inf"} 4`,
+		`test_activity_xact_age_sum{datname="a"} 760.5`,
+		`test_activity_xact_age_count{datname="a"} 4`,
+	})
+}
+
+func TestScrapeSummary(t *testing.T) {
+	recipe := `
+  activity:
+    query: SELECT 1
+    metrics:
+      - datname:
+          usage: LABEL
+      - xact_age:
+          usage: SUMMARY
+          description: transaction age
+`
+	var rows [][]interface{}
+	for _, v := range []float64{7, 3, 10, 1, 9, 2, 8, 4, 6, 5} {
+		rows = append(rows, []interface{}{"a", v})
+	}
+	got := scrapeRows(t, recipe, []string{"datname", "xact_age"}, rows...)
+	// Nearest rank: the ceil(q*n)th smallest value.
+	checkSamples(t, got, []string{
+		`test_activity_xact_age{datname="a",quantile="0.5"} 5`,
+		`test_activity_xact_age{datname="a",quantile="0.9"} 9`,
+		`test_activity_xact_age{datname="a",quantile="0.99"} 10`,
+		`test_activity_xact_age_sum{datname="a"} 55`,
+		`test_activity_xact_age_count{datname="a"} 10`,
+	})
+
+	got = scrapeRows(t, strings.Replace(recipe, "description: transaction age",
+		"description: transaction age\n          quantiles: [0.01, 0.25, 1]", 1),
+		[]string{"datname", "xact_age"}, rows...)
+	checkSamples(t, got, []string{
+		`test_activity_xact_age{datname="a",quantile="0.01"} 1`,
+		`test_activity_xact_age{datname="a",quantile="0.25"} 3`,
+		`test_activity_xact_age{datname="a",quantile="1"} 10`,
+		`test_activity_xact_age_sum{datname="a"} 55`,
+		`test_activity_xact_age_count{datname="a"} 10`,
+	})
+}
+
+func TestScrapeInfo(t *testing.T) {
+	got := scrapeRows(t, `
+  settings:
+    query: SELECT 1
+    metrics:
+      - name:
+          usage: LABEL
+      - setting:
+          usage: INFO
+      - unit:
+          usage: INFO
+      - source:
+          usage: DISCARD
+`, []string{"name", "setting", "unit", "source"},
+		// Rows with the same label values yield a single info series.
+		[]interface{}{"wal_level", "replica", "", "default"},
+		[]interface{}{"wal_level", "replica", "", "configuration file"},
+		[]interface{}{"work_mem", "4096", "kB", "default"},
+		[]interface{}{"work_mem", "8192", "kB", "session"},
+	)
+	checkSamples(t, got, []string{
+		`test_settings_info{name="wal_level",setting="replica",unit=""} 1`,
+		`test_settings_info{name="work_mem",setting="4096",unit="kB"} 1`,
+		`test_settings_info{name="work_mem",setting="8192",unit="kB"} 1`,
+	})
+}
+
+func TestScrapeInvalidUTF8(t *testing.T) {
+	// Latin-1 text, e.g. from a Sybase server, is not valid UTF-8.
+	got := scrapeRows(t, `
+  settings:
+    query: SELECT 1
+    metrics:
+      - name:
+          usage: LABEL
+      - setting:
+          usage: INFO
+      - state:
+          usage: STATESET
+          description: setting state
+          states: [default, custom]
+`, []string{"name", "setting", "state"},
+		[]interface{}{"caf\xe9", []byte("na\xefve"), "custom"},
+	)
+	checkSamples(t, got, []string{
+		"test_settings_info{name=\"caf\ufffd\",setting=\"na\ufffdve\"} 1",
+		"test_settings_state{name=\"caf\ufffd\",state=\"custom\"} 1",
+		"test_settings_state{name=\"caf\ufffd\",state=\"default\"} 0",
+	})
+}
+
+func TestScrapeStateset(t *testing.T) {
+	got := scrapeRows(t, `
+  activity:
+    query: SELECT 1
+    metrics:
+      - pid:
+          usage: LABEL
+      - state:
+          usage: STATESET
+          description: backend state
+          states: [active, idle, idle in transaction]
+`, []string{"pid", "state"},
+		// Text is matched ignoring case, and text that isn't a state
+		// yields 0 for every state.
+		[]interface{}{int64(1), "Active"},
+		[]interface{}{int64(2), "idle in transaction"},
+		[]interface{}{int64(3), "disabled"},
+	)
+	checkSamples(t, got, []string{
+		`test_activity_state{pid="1",state="active"} 1`,
+		`test_activity_state{pid="1",state="idle"} 0`,
+		`test_activity_state{pid="1",state="idle in transaction"} 0`,
+		`test_activity_state{pid="2",state="active"} 0`,
+		`test_activity_state{pid="2",state="idle"} 0`,
+		`test_activity_state{pid="2",state="idle in transaction"} 1`,
+		`test_activity_state{pid="3",state="active"} 0`,
+		`test_activity_state{pid="3",state="idle"} 0`,
+		`test_activity_state{pid="3",state="idle in transaction"} 0`,
+	})
+}
+
+func TestScrapeTimestamp(t *testing.T) {
+	recipe := `
+  history:
+    query: SELECT 1
+    metrics:
+      - id:
+          usage: LABEL
+      - sample_time:
+          usage: TIMESTAMP%s
+      - value:
+          usage: GAUGE
+          description: sampled value
+`
+	now := time.Now().Truncate(time.Second)
+	sample := func(id string, ts interface{}) []interface{} {
+		return []interface{}{id, ts, 1.0}
+	}
+	series := func(id string, ts time.Time) string {
+		s := fmt.Sprintf(`test_history_value{id=%q} 1`, id)
+		if !ts.IsZero() {
+			s += fmt.Sprintf(" %d", ts.UnixNano()/int64(time.Millisecond))
+		}
+		return s
+	}
+	colnames := []string{"id", "sample_time", "value"}
+
+	got := scrapeRows(t, fmt.Sprintf(recipe, ""), colnames,
+		sample("recent", now.Add(-time.Minute)),
+		sample("epoch", float64(now.Add(-time.Minute).Unix())),
+		sample("old", now.Add(-2*time.Hour)),
+		sample("future", now.Add(10*time.Minute)),
+		sample("null", nil),
+	)
+	checkSamples(t, got, []string{
+		series("epoch", now.Add(-time.Minute)),
+		series("future", time.Time{}),
+		series("null", time.Time{}),
+		series("old", time.Time{}),
+		series("recent", now.Add(-time.Minute)),
+	})
+
+	got = scrapeRows(t, fmt.Sprintf(recipe, "\n          max_age: 3h\n          max_future: 20m"), colnames,
+		sample("old", now.Add(-2*time.Hour)),
+		sample("older", now.Add(-4*time.Hour)),
+		sample("future", now.Add(10*time.Minute)),
+		sample("further", now.Add(30*time.Minute)),
+	)
+	checkSamples(t, got, []string{
+		series("further", time.Time{}),
+		series("future", now.Add(10*time.Minute)),
+		series("old", now.Add(-2*time.Hour)),
+		series("older", time.Time{}),
+	})
+
+	// Text without a zone is in local time, unless the column gives one.
+	const layout = "2006-01-02 15:04:05"
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = scrapeRows(t, fmt.Sprintf(recipe, ""), colnames,
+		sample("local", now.Add(-time.Minute).Format(layout)))
+	checkSamples(t, got, []string{series("local", now.Add(-time.Minute))})
+	got = scrapeRows(t, fmt.Sprintf(recipe, "\n          timezone: Asia/Tokyo"), colnames,
+		sample("tokyo", now.Add(-time.Minute).In(tokyo).Format(layout)))
+	checkSamples(t, got, []string{series("tokyo", now.Add(-time.Minute))})
+}
+
+func TestScrapeFailureIsolation(t *testing.T) {
+	conn := &stubConn{
+		results: map[string][]db.ScannedResultSet{
+			"SELECT 1": {{Colnames: []string{"value"}, Rows: [][]interface{}{{2.0}}}},
+			"SELECT 3": {{Colnames: []string{"value"}, Rows: [][]interface{}{{3.0}}}},
+		},
+		errs: map[string]error{"SELECT 2": errors.New("no such table")},
+	}
+	e := stubExporter(t, `
+  first:
+    query: SELECT 1
+    metrics:
+      - value:
+          usage: GAUGE
+          description: first value
+  broken:
+    query: SELECT 2
+    metrics:
+      - value:
+          usage: GAUGE
+          description: broken value
+  last:
+    query: SELECT 3
+    metrics:
+      - value:
+          usage: GAUGE
+          description: last value
+`, ExporterOptions{}, func() (db.Conn, error) { return conn, nil })
+
+	got := scrapeSamples(t, e, "test_", "postgres_up", "postgres_exporter_scrape_errors_total", "postgres_exporter_recipe_success")
+	checkSamples(t, got, []string{
+		`postgres_exporter_recipe_success{namespace="test_broken"} 0`,
+		`postgres_exporter_recipe_success{namespace="test_first"} 1`,
+		`postgres_exporter_recipe_success{namespace="test_last"} 1`,
+		`postgres_exporter_scrape_errors_total{kind="other",namespace="test_broken"} 1`,
+		`postgres_up 1`,
+		`test_first_value 2`,
+		`test_last_value 3`,
+	})
+}
+
+func TestScrapeUp(t *testing.T) {
+	conn := &stubConn{results: map[string][]db.ScannedResultSet{
+		"SELECT value": {{Colnames: []string{"value"}, Rows: [][]interface{}{{1.0}}}},
+		"SELECT 1":     {{Colnames: []string{"1"}, Rows: [][]interface{}{{int64(1)}}}},
+	}}
+	e := stubExporter(t, `
+  hourly:
+    query: SELECT value
+    interval: 1h
+    metrics:
+      - value:
+          usage: GAUGE
+          description: hourly value
+`, ExporterOptions{}, func() (db.Conn, error) { return conn, nil })
+
+	checkSamples(t, scrapeSamples(t, e, "postgres_up"), []string{"postgres_up 1"})
+	if want := []string{"SELECT value"}; !reflect.DeepEqual(conn.queries, want) {
+		t.Errorf("got queries %q, want %q", conn.queries, want)
+	}
+
+	// With the results cached, up is determined by pinging the DB.
+	conn.queries = nil
+	checkSamples(t, scrapeSamples(t, e, "postgres_up", "test_"), []string{
+		"postgres_up 1",
+		"test_hourly_value 1",
+	})
+	if want := []string{"SELECT 1"}; !reflect.DeepEqual(conn.queries, want) {
+		t.Errorf("got queries %q, want %q", conn.queries, want)
+	}
+
+	conn.err = io.ErrUnexpectedEOF
+	checkSamples(t, scrapeSamples(t, e, "postgres_up", "postgres_exporter_scrape_errors_total"), []string{
+		`postgres_exporter_scrape_errors_total{kind="connect",namespace=""} 1`,
+		"postgres_up 0",
+	})
+}
+
+func TestScrapeLazyConnectFailure(t *testing.T) {
+	// Like lib/pq, the stub's open succeeds and its first query fails.
+	opens := 0
+	e := stubExporter(t, `
+  first:
+    query: SELECT 1
+    metrics:
+      - value:
+          usage: GAUGE
+          description: first value
+  second:
+    query: SELECT 2
+    metrics:
+      - value:
+          usage: GAUGE
+          description: second value
+`, ExporterOptions{}, func() (db.Conn, error) {
+		opens++
+		return &stubConn{err: io.ErrUnexpectedEOF}, nil
+	})
+
+	got := scrapeSamples(t, e, "postgres_up", "postgres_exporter_scrape_errors_total", "postgres_exporter_recipe_success")
+	checkSamples(t, got, []string{
+		`postgres_exporter_recipe_success{namespace="test_first"} 0`,
+		`postgres_exporter_recipe_success{namespace="test_second"} 0`,
+		`postgres_exporter_scrape_errors_total{kind="connect",namespace="test_first"} 1`,
+		"postgres_up 0",
+	})
+	if opens != 1 {
+		t.Errorf("got %d connections opened, want 1", opens)
+	}
+}
+
+func TestRecipeSchedule(t *testing.T) {
+	rs, err := config.GetRecipes("test", `
+  hourly:
+    query: SELECT 1
+    interval: 1h
+    metrics:
+      - value:
+          usage: GAUGE
+          description: hourly value
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	e := NewExporter("postgres", nil, rs, ExporterOptions{})
+	recipe := rs[0]
+
+	// The first run is immediate.
+	if cache := e.cachedResults(recipe); cache != nil {
+		t.Fatalf("recipe not run yet, but got cached results from %v", cache.ran)
+	}
+
+	// The second run is spread out over the interval.
+	ran := time.Now()
+	cache := e.storeResults(recipe, nil, ran)
+	if !cache.next.After(ran) || cache.next.After(ran.Add(time.Hour)) {
+		t.Errorf("after the first run, next run at %v, want within an hour of %v", cache.next, ran)
+	}
+	if e.cachedResults(recipe) != cache {
+		t.Errorf("cached results not used before the next run")
+	}
+
+	// Later runs are an interval apart.
+	ran = cache.next
+	if cache = e.storeResults(recipe, nil, ran); !cache.next.Equal(ran.Add(time.Hour)) {
+		t.Errorf("after the second run, next run at %v, want %v", cache.next, ran.Add(time.Hour))
+	}
+}
+
+func TestScrapeInBackground(t *testing.T) {
+	conn := &stubConn{results: map[string][]db.ScannedResultSet{
+		"SELECT 1": {{Colnames: []string{"value"}, Rows: [][]interface{}{{1.0}}}},
+	}}
+	e := stubExporter(t, `
+  first:
+    query: SELECT 1
+    metrics:
+      - value:
+          usage: GAUGE
+          description: first value
+`, ExporterOptions{ScrapeInterval: time.Hour}, func() (db.Conn, error) { return conn, nil })
+	start := time.Now()
+	e.Start()
+
+	// Collect waits for the first background scrape.
+	samples := gatherSamples(t, e)
+	var ts, age float64
+	var got []string
+	for _, sample := range samples {
+		switch {
+		case strings.HasPrefix(sample, "postgres_exporter_last_snapshot_timestamp_seconds "):
+			fmt.Sscan(strings.Fields(sample)[1], &ts)
+		case strings.HasPrefix(sample, "postgres_exporter_snapshot_age_seconds "):
+			fmt.Sscan(strings.Fields(sample)[1], &age)
+		case strings.HasPrefix(sample, "postgres_up"), strings.HasPrefix(sample, "test_"):
+			got = append(got, sample)
+		}
+	}
+	checkSamples(t, got, []string{"postgres_up 1", "test_first_value 1"})
+	if ts < float64(start.Unix()) || ts > float64(time.Now().Unix()+1) {
+		t.Errorf("got snapshot timestamp %v, want between %v and now", ts, start.Unix())
+	}
+	if age < 0 || age > time.Since(start).Seconds() {
+		t.Errorf("got snapshot age %v, want between 0 and %v", age, time.Since(start).Seconds())
+	}
+}
+
+func TestScrapeInBackgroundTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	e := stubExporter(t, `
+  first:
+    query: SELECT 1
+    metrics:
+      - value:
+          usage: GAUGE
+          description: first value
+`, ExporterOptions{ScrapeInterval: time.Hour}, func() (db.Conn, error) {
+		<-release
+		return nil, errors.New("connection refused")
+	})
+	e.Start()
+
+	// If the first background scrape doesn't complete in time, the DB is
+	// reported down.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	got := gatherSamples(t, collectorFunc(func(ch chan<- prometheus.Metric) {
+		e.CollectContext(ctx, ch)
+	}))
+	checkSamples(t, got, []string{
+		`postgres_exporter_scrape_errors_total{kind="timeout",namespace=""} 1`,
+		"postgres_up 0",
+	})
+}
+
+// poolStats tracks the connections opened by a stub exporter and how many
+// of them are querying at once.
+type poolStats struct {
+	mu                   sync.Mutex
+	opens, busy, maxBusy int
+}
+
+// busyConn is a stubConn that takes a while to answer each query.
+type busyConn struct {
+	*stubConn
+	stats *poolStats
+}
+
+func (c *busyConn) Query(ctx context.Context, q string) ([]db.ScannedResultSet, error) {
+	c.stats.mu.Lock()
+	c.stats.busy++
+	if c.stats.busy > c.stats.maxBusy {
+		c.stats.maxBusy = c.stats.busy
+	}
+	c.stats.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.stats.mu.Lock()
+	c.stats.busy--
+	c.stats.mu.Unlock()
+	return c.stubConn.Query(ctx, q)
+}
+
+func TestScrapeConcurrency(t *testing.T) {
+	var content strings.Builder
+	results := make(map[string][]db.ScannedResultSet)
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(&content, `
+  recipe%d:
+    query: SELECT %d
+    metrics:
+      - value:
+          usage: GAUGE
+          description: recipe value
+`, i, i)
+		results[fmt.Sprintf("SELECT %d", i)] = []db.ScannedResultSet{{Colnames: []string{"value"}, Rows: [][]interface{}{{float64(i)}}}}
+	}
+	var stats poolStats
+	e := stubExporter(t, content.String(), ExporterOptions{Concurrency: 2, PersistentConnection: true}, func() (db.Conn, error) {
+		stats.mu.Lock()
+		stats.opens++
+		stats.mu.Unlock()
+		return &busyConn{&stubConn{results: results}, &stats}, nil
+	})
+	e.Start()
+
+	// Concurrent requests are served by scrapes sharing the same pool.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch := make(chan prometheus.Metric)
+			go func() {
+				for range ch {
+				}
+			}()
+			e.Collect(ch)
+			close(ch)
+		}()
+	}
+	wg.Wait()
+
+	if stats.opens != 2 {
+		t.Errorf("got %d connections opened, want 2", stats.opens)
+	}
+	if stats.maxBusy != 2 {
+		t.Errorf("got up to %d queries at once, want 2", stats.maxBusy)
+	}
+}
+
+func TestScrapeMapped(t *testing.T) {
+	recipe := `
+  activity:
+    query: SELECT 1
+    metrics:
+      - pid:
+          usage: LABEL
+      - state:
+          usage: MAPPEDMETRIC
+          description: backend state
+          mapping:
+            active: 1
+            idle: 0%s
+`
+	rows := [][]interface{}{{int64(1), "Active"}, {int64(2), "idle"}, {int64(3), "disabled"}}
+	got := scrapeRows(t, fmt.Sprintf(recipe, ""), []string{"pid", "state"}, rows...)
+	// Text not in the mapping yields no sample without a default.
+	checkSamples(t, got, []string{
+		`test_activity_state{pid="1"} 1`,
+		`test_activity_state{pid="2"} 0`,
+	})
+
+	got = scrapeRows(t, fmt.Sprintf(recipe, "\n          default: -1"), []string{"pid", "state"}, rows...)
+	checkSamples(t, got, []string{
+		`test_activity_state{pid="1"} 1`,
+		`test_activity_state{pid="2"} 0`,
+		`test_activity_state{pid="3"} -1`,
+	})
+}
+
+func TestScrapeParallelItems(t *testing.T) {
+	results := map[string][]db.ScannedResultSet{
+		"SELECT name FROM dbs": {{Colnames: []string{"name"}, Rows: [][]interface{}{{"a"}, {"b"}, {"c"}, {"d"}}}},
+	}
+	for i, name := range []string{"a", "b", "c", "d"} {
+		results["SELECT value FROM "+name] = []db.ScannedResultSet{{Colnames: []string{"value"}, Rows: [][]interface{}{{float64(i)}}}}
+	}
+	var stats poolStats
+	e := stubExporter(t, `
+  sizes:
+    rangeover: SELECT name FROM dbs
+    query: SELECT value FROM {{.}}
+    parallel: 4
+    metrics:
+      - value:
+          usage: GAUGE
+          description: size
+`, ExporterOptions{Concurrency: 2}, func() (db.Conn, error) {
+		stats.mu.Lock()
+		stats.opens++
+		stats.mu.Unlock()
+		return &busyConn{&stubConn{results: results}, &stats}, nil
+	})
+
+	// The items run in parallel on the connections of the pool, which
+	// parallel can't enlarge.
+	checkSamples(t, scrapeSamples(t, e, "test_"), []string{
+		`test_sizes_value{name="a"} 0`,
+		`test_sizes_value{name="b"} 1`,
+		`test_sizes_value{name="c"} 2`,
+		`test_sizes_value{name="d"} 3`,
+	})
+	if stats.opens != 2 {
+		t.Errorf("got %d connections opened, want 2", stats.opens)
+	}
+	if stats.maxBusy != 2 {
+		t.Errorf("got up to %d queries at once, want 2", stats.maxBusy)
+	}
+}
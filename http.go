@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+)
+
+// labelledExporter is an Exporter along with the constant labels to add to
+// all its metrics.
+type labelledExporter struct {
+	exporter *Exporter
+	labels   prometheus.Labels
+}
+
+// contextCollector adapts an Exporter to scrape within the deadline of an
+// HTTP request.  It describes no metrics, making it an unchecked collector,
+// so that registering it doesn't trigger a scrape.
+type contextCollector struct {
+	ctx      context.Context
+	exporter *Exporter
+}
+
+// Describe implements prometheus.Collector.
+func (cc contextCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (cc contextCollector) Collect(ch chan<- prometheus.Metric) {
+	cc.exporter.CollectContext(cc.ctx, ch)
+}
+
+// MetricsHandler serves the metrics of a set of exporters along with those
+// of the default registry (process and Go runtime metrics).
+type MetricsHandler struct {
+	exporters []labelledExporter
+}
+
+// Add makes h serve the metrics of e, adding labels to them.
+func (h *MetricsHandler) Add(e *Exporter, labels prometheus.Labels) {
+	h.exporters = append(h.exporters, labelledExporter{e, labels})
+}
+
+// ServeHTTP implements http.Handler.
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveExporters(w, r, prometheus.DefaultGatherer, h.exporters)
+}
+
+// serveExporters scrapes the given exporters within the deadline of the
+// request, then writes their metrics to w, along with those of g if not nil.
+func serveExporters(w http.ResponseWriter, r *http.Request, g prometheus.Gatherer, exporters []labelledExporter) {
+	ctx, cancel := scrapeContext(r)
+	defer cancel()
+
+	reg := prometheus.NewRegistry()
+	for _, le := range exporters {
+		err := prometheus.WrapRegistererWith(le.labels, reg).Register(contextCollector{ctx, le.exporter})
+		if err != nil {
+			log.Errorf("error registering exporter: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	gatherers := prometheus.Gatherers{reg}
+	if g != nil {
+		gatherers = append(gatherers, g)
+	}
+	serveGatherer(w, r, gatherers)
+}
+
+// scrapeContext returns a context for scraping in response to r.  If
+// Prometheus supplied its scrape timeout in the request headers, the context
+// expires -scrape.timeout-offset before then, leaving time to respond.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx := r.Context()
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return context.WithCancel(ctx)
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		log.Warnf("ignoring bad X-Prometheus-Scrape-Timeout-Seconds header %q: %v", header, err)
+		return context.WithCancel(ctx)
+	}
+	timeout := time.Duration(seconds*float64(time.Second)) - *scrapeTimeoutOffset
+	if timeout <= 0 {
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// serveGatherer writes the metrics gathered from g to w in the format
+// negotiated with the client.
+func serveGatherer(w http.ResponseWriter, r *http.Request, g prometheus.Gatherer) {
+	mfs, err := g.Gather()
+	if err != nil {
+		log.Errorf("error gathering metrics: %v", err)
+		if len(mfs) == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	contentType := expfmt.Negotiate(r.Header)
+	w.Header().Set("Content-Type", string(contentType))
+	enc := expfmt.NewEncoder(w, contentType)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			log.Errorf("error encoding metric family %q: %v", mf.GetName(), err)
+			return
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ncabatoff/dbms_exporter/config"
+	"github.com/ncabatoff/dbms_exporter/db"
+	"github.com/ncabatoff/dbms_exporter/recipes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// defaultModule is the module used by /probe when none is specified; it
+// consists of the recipes the target was configured with.
+const defaultModule = "default"
+
+// ProbeTarget describes a database that may be scraped via /probe.
+type ProbeTarget struct {
+	// Driver is the name the target's recipes were read with; it's also
+	// the prefix of all the target's metrics.
+	Driver string
+	DSN    config.DSNSource
+	// Labels are constant labels added to all metrics of the target.
+	Labels prometheus.Labels
+	// Recipes make up the target's default module.
+	Recipes []recipes.MetricQueryRecipe
+	// RecipeFiles are the files Recipes were read from.
+	RecipeFiles []string
+}
+
+// probeKey identifies a cached per-target exporter.
+type probeKey struct {
+	target string
+	module string
+}
+
+// moduleKey identifies a module's recipes as parsed for a given driver.
+type moduleKey struct {
+	module string
+	driver string
+}
+
+// ProbeHandler serves /probe requests, scraping the requested target using
+// the recipes of the requested module.  Each target/module pair gets its own
+// Exporter, created on first use and reused afterwards.
+type ProbeHandler struct {
+	opts ExporterOptions
+	// modulePaths maps module names to recipe files.
+	modulePaths map[string]string
+
+	mu sync.Mutex
+	// targets maps allowed target names to their details.
+	targets   map[string]ProbeTarget
+	modules   map[moduleKey][]recipes.MetricQueryRecipe
+	exporters map[probeKey]*Exporter
+}
+
+// NewProbeHandler returns a handler that will only scrape the given targets.
+func NewProbeHandler(targets map[string]ProbeTarget, modulePaths map[string]string, opts ExporterOptions) *ProbeHandler {
+	return &ProbeHandler{
+		opts:        opts,
+		targets:     targets,
+		modulePaths: modulePaths,
+		modules:     make(map[moduleKey][]recipes.MetricQueryRecipe),
+		exporters:   make(map[probeKey]*Exporter),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (ph *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	module := r.URL.Query().Get("module")
+	if module == "" {
+		module = defaultModule
+	}
+
+	ph.mu.Lock()
+	e, err := ph.exporter(target, module)
+	labels := ph.targets[target].Labels
+	ph.mu.Unlock()
+	if err != nil {
+		log.Warnf("refusing probe of target %q module %q: %v", target, module, err)
+		http.Error(w, err.Error(), err.status)
+		return
+	}
+	serveExporters(w, r, nil, []labelledExporter{{e, labels}})
+}
+
+// probeError is an error carrying the HTTP status to report it with.
+type probeError struct {
+	status int
+	msg    string
+}
+
+func (pe *probeError) Error() string {
+	return pe.msg
+}
+
+// Exporter returns the exporter for the given target and module, creating
+// it if needed.
+func (ph *ProbeHandler) Exporter(target, module string) (*Exporter, error) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	e, err := ph.exporter(target, module)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// exporter must be called with mu held.
+func (ph *ProbeHandler) exporter(target, module string) (*Exporter, *probeError) {
+	pt, ok := ph.targets[target]
+	if !ok {
+		return nil, &probeError{http.StatusForbidden, fmt.Sprintf("target %q is not allowed", target)}
+	}
+
+	key := probeKey{target: target, module: module}
+	if e, ok := ph.exporters[key]; ok {
+		return e, nil
+	}
+
+	rcps, perr := ph.recipes(pt, module)
+	if perr != nil {
+		return nil, perr
+	}
+
+	driver := pt.Driver
+	if driver == "sybase" {
+		driver = "freetds"
+	}
+	opts := ph.opts
+	opts.Target = target
+	e := NewExporter(driver, pt.DSN, rcps, opts)
+	e.Start()
+	ph.exporters[key] = e
+	return e, nil
+}
+
+// Reload rereads the recipe files of all targets and of the modules in use,
+// and makes the exporters use the new recipes.  If any file can't be read
+// nothing is changed.
+func (ph *ProbeHandler) Reload() error {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	targets := make(map[string]ProbeTarget, len(ph.targets))
+	for name, pt := range ph.targets {
+		rcps, err := config.ReadRecipesFiles(pt.RecipeFiles, pt.Driver)
+		if err != nil {
+			return fmt.Errorf("target %q: %v", name, err)
+		}
+		pt.Recipes = rcps
+		targets[name] = pt
+	}
+	modules := make(map[moduleKey][]recipes.MetricQueryRecipe, len(ph.modules))
+	for mkey := range ph.modules {
+		path := ph.modulePaths[mkey.module]
+		rcps, err := config.ReadRecipesFile(path, mkey.driver)
+		if err != nil {
+			return fmt.Errorf("module %q: %v", mkey.module, err)
+		}
+		modules[mkey] = rcps
+	}
+
+	ph.targets, ph.modules = targets, modules
+	for key, e := range ph.exporters {
+		rcps, perr := ph.recipes(ph.targets[key.target], key.module)
+		if perr != nil {
+			// Can't happen: every module in use was reread above.
+			return perr
+		}
+		e.SetRecipes(rcps)
+	}
+	return nil
+}
+
+// recipes returns the recipes of the given module for the given target; it
+// must be called with mu held.
+func (ph *ProbeHandler) recipes(pt ProbeTarget, module string) ([]recipes.MetricQueryRecipe, *probeError) {
+	if module == defaultModule {
+		return pt.Recipes, nil
+	}
+	path, ok := ph.modulePaths[module]
+	if !ok {
+		return nil, &probeError{http.StatusBadRequest, fmt.Sprintf("unknown module %q", module)}
+	}
+	mkey := moduleKey{module: module, driver: pt.Driver}
+	if rcps, ok := ph.modules[mkey]; ok {
+		return rcps, nil
+	}
+	rcps, err := config.ReadRecipesFile(path, pt.Driver)
+	if err != nil {
+		return nil, &probeError{http.StatusInternalServerError, fmt.Sprintf("module %q: %v", module, err)}
+	}
+	ph.modules[mkey] = rcps
+	return rcps, nil
+}
+
+// parseProbeTargets turns a comma-separated list of target names into a map
+// from name to ProbeTarget.  The DSN for each target is read from the environment
+// variable DATA_SOURCE_NAME_<NAME>, or the file named by
+// DATA_SOURCE_NAME_<NAME>_FILE, where NAME is the target name in upper case
+// with anything other than letters and digits replaced by underscores.
+func parseProbeTargets(list, driver string, queriesPaths []string, rcps []recipes.MetricQueryRecipe) (map[string]ProbeTarget, error) {
+	targets := make(map[string]ProbeTarget)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		envName := probeTargetEnv(name)
+		dsn, err := config.EnvDSN(envName)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %v", name, err)
+		}
+		if dsn == nil {
+			return nil, fmt.Errorf("couldn't find environment variable %s or %s_FILE for target %q", envName, envName, name)
+		}
+		targets[name] = ProbeTarget{Driver: driver, DSN: dsn, Recipes: rcps, RecipeFiles: queriesPaths}
+	}
+	return targets, nil
+}
+
+func probeTargetEnv(name string) string {
+	return "DATA_SOURCE_NAME_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// parseProbeModules turns a comma-separated list of module=queryfile pairs
+// into a map from module name to queryfile path.
+func parseProbeModules(list string) (map[string]string, error) {
+	modules := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("bad module definition %q, want name=queryfile", pair)
+		}
+		if _, dup := modules[kv[0]]; dup || kv[0] == defaultModule {
+			return nil, fmt.Errorf("module %q defined more than once", kv[0])
+		}
+		modules[kv[0]] = kv[1]
+	}
+	return modules, nil
+}
+
+// configProbeTargets builds the targets described by cfg, reading their
+// recipe files.  Each target's metrics are labelled with its name in
+// addition to any labels configured.
+func configProbeTargets(cfg *config.ExporterConfig) (map[string]ProbeTarget, error) {
+	targets := make(map[string]ProbeTarget)
+	for _, name := range cfg.TargetNames() {
+		t := cfg.Targets[name]
+		rcps, err := config.ReadRecipesFiles(t.RecipeFiles, t.Driver)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %v", name, err)
+		}
+		labels := prometheus.Labels{"target": name}
+		for k, v := range t.Labels {
+			labels[k] = v
+		}
+		targets[name] = ProbeTarget{Driver: t.Driver, DSN: t.GetDSN, Labels: labels, Recipes: rcps, RecipeFiles: t.RecipeFiles}
+	}
+	return targets, nil
+}
+
+// sortedTargetNames returns the names of targets in sorted order.
+func sortedTargetNames(targets map[string]ProbeTarget) []string {
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkDriver returns an error if the named driver isn't available.
+func checkDriver(driver string) error {
+	if driver == "sybase" {
+		driver = "freetds"
+	}
+	for _, d := range db.Drivers() {
+		if d == driver {
+			return nil
+		}
+	}
+	return fmt.Errorf("driver %q not supported in this build", driver)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ncabatoff/dbms_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestProbeAllowlist(t *testing.T) {
+	rs, err := config.GetRecipes("postgres", `
+  recipe1:
+    query: SELECT 1 AS met1
+    metrics:
+      - met1:
+          usage: GAUGE
+          description: desc1
+`)
+	if err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	ph := NewProbeHandler(map[string]ProbeTarget{
+		"db1": {Driver: "postgres", DSN: config.StaticDSN("dsn1"), Labels: prometheus.Labels{"target": "db1"}, Recipes: rs},
+	}, nil, ExporterOptions{})
+
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"target=db2", http.StatusForbidden},
+		{"target=db1&module=nosuchmodule", http.StatusBadRequest},
+		{"target=db1", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		ph.ServeHTTP(w, httptest.NewRequest("GET", "/probe?"+tc.query, nil))
+		if w.Code != tc.status {
+			t.Errorf("probe with %q returned status %d, want %d", tc.query, w.Code, tc.status)
+		}
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `postgres_up{target="db1"}`) {
+			t.Errorf("probe with %q returned no up metric for the target:\n%s", tc.query, w.Body.String())
+		}
+	}
+}
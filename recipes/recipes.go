@@ -2,9 +2,14 @@ package recipes
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"sort"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/ncabatoff/dbms_exporter/common"
 	"github.com/ncabatoff/dbms_exporter/db"
@@ -43,9 +48,27 @@ type MetricQueryRecipe interface {
 	// column in the resultset should be looked up in this map to determine
 	// how to handle it.
 	GetResultMaps() MultiResultMap
+	// Returns the minimum time between runs of the recipe; scrapes in
+	// between should reuse the results of the last run.  Zero means run
+	// on every scrape.
+	GetInterval() time.Duration
+	// Returns the maximum time a run of the recipe may take, zero meaning
+	// no limit other than that of the scrape.
+	GetTimeout() time.Duration
+	// Returns the priority of the recipe: recipes with a higher priority
+	// are run first, and are the last to be skipped when a scrape runs
+	// out of time.
+	GetPriority() int
+	// Returns the range of server versions the recipe applies to.
+	GetVersions() VersionRange
+	// Returns the condition deciding whether the recipe runs, or nil.
+	GetCondition() *Condition
+	// Returns the definition the recipe was built from; recipes with the
+	// same source behave the same.
+	GetSource() string
 	// Run executes one or more queries and returns one or more resultsets.
 	// There need not be a one-to-one mapping.
-	Run(db.Conn) ([]db.ScannedResultSet, error)
+	Run(context.Context, db.Conn) ([]db.ScannedResultSet, error)
 }
 
 // MetricQueryRecipeBase is common to all recipes.
@@ -56,6 +79,19 @@ type MetricQueryRecipeBase struct {
 	// ResultMaps maps column names in resultsets to the ColumnMapping
 	// that should be used to build a metric.
 	Resultmaps MultiResultMap
+	// Interval is the minimum time between runs, zero meaning every scrape.
+	Interval time.Duration
+	// Timeout limits the duration of a run, zero meaning no limit.
+	Timeout time.Duration
+	// Priority orders recipes, higher first; the default is zero.
+	Priority int
+	// Versions limits the recipe to servers of certain versions.
+	Versions VersionRange
+	// When, if not nil, decides whether the recipe runs.
+	When *Condition
+	// Source is the definition of the recipe, used to tell whether a
+	// reloaded recipe changed.
+	Source string
 }
 
 // GetNamespace implements MetricQueryRecipe.
@@ -68,14 +104,152 @@ func (mqrb *MetricQueryRecipeBase) GetResultMaps() MultiResultMap {
 	return mqrb.Resultmaps
 }
 
+// GetInterval implements MetricQueryRecipe.
+func (mqrb *MetricQueryRecipeBase) GetInterval() time.Duration {
+	return mqrb.Interval
+}
+
+// GetTimeout implements MetricQueryRecipe.
+func (mqrb *MetricQueryRecipeBase) GetTimeout() time.Duration {
+	return mqrb.Timeout
+}
+
+// GetPriority implements MetricQueryRecipe.
+func (mqrb *MetricQueryRecipeBase) GetPriority() int {
+	return mqrb.Priority
+}
+
+// GetVersions implements MetricQueryRecipe.
+func (mqrb *MetricQueryRecipeBase) GetVersions() VersionRange {
+	return mqrb.Versions
+}
+
+// GetCondition implements MetricQueryRecipe.
+func (mqrb *MetricQueryRecipeBase) GetCondition() *Condition {
+	return mqrb.When
+}
+
+// GetSource implements MetricQueryRecipe.
+func (mqrb *MetricQueryRecipeBase) GetSource() string {
+	return mqrb.Source
+}
+
+// DefaultConditionInterval is how long the result of a Condition is reused
+// when it doesn't specify an interval.
+const DefaultConditionInterval = 5 * time.Minute
+
+// Condition is a query whose boolean result decides whether a recipe runs,
+// e.g. whether the server is a replica or an extension is installed.
+type Condition struct {
+	Query string
+	// Interval is how long the result may be reused on a connection
+	// before the query is run again.
+	Interval time.Duration
+}
+
+// Check runs the condition query on conn.  The first column of the first
+// row is the result; no rows at all means false.
+func (c *Condition) Check(ctx context.Context, conn db.Conn) (bool, error) {
+	log.Debugln("running condition SQL: ", c.Query)
+	srss, err := conn.Query(ctx, c.Query)
+	if err != nil {
+		return false, &db.QueryError{Query: c.Query, Err: err}
+	}
+	if len(srss) == 0 || len(srss[0].Rows) == 0 || len(srss[0].Rows[0]) == 0 {
+		return false, nil
+	}
+	result, ok := db.ToBool(srss[0].Rows[0][0])
+	if !ok {
+		return false, fmt.Errorf("condition %q returned non-boolean value %v", c.Query, srss[0].Rows[0][0])
+	}
+	return result, nil
+}
+
+// VersionRange limits a recipe or query to servers of certain versions.
+// Nil bounds are unlimited.  Max includes the versions it's a prefix of, so
+// that a Max of 9.6 includes 9.6.5.
+type VersionRange struct {
+	Min, Max db.Version
+}
+
+// IsZero returns true if vr doesn't limit versions at all.
+func (vr VersionRange) IsZero() bool {
+	return vr.Min == nil && vr.Max == nil
+}
+
+// Contains returns true if v is within vr.
+func (vr VersionRange) Contains(v db.Version) bool {
+	if vr.Min != nil && v.Compare(vr.Min) < 0 {
+		return false
+	}
+	if vr.Max != nil && v.Truncate(len(vr.Max)).Compare(vr.Max) > 0 {
+		return false
+	}
+	return true
+}
+
+// String returns vr in a form suitable for DumpMaps.
+func (vr VersionRange) String() string {
+	var parts []string
+	if vr.Min != nil {
+		parts = append(parts, "min_version: "+vr.Min.String())
+	}
+	if vr.Max != nil {
+		parts = append(parts, "max_version: "+vr.Max.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// appliesTo returns true if vr contains the version of the server conn is
+// connected to.  The version is only looked up if vr limits it.
+func (vr VersionRange) appliesTo(ctx context.Context, conn db.Conn) (bool, error) {
+	if vr.IsZero() {
+		return true, nil
+	}
+	v, err := conn.Version(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unable to determine server version: %v", err)
+	}
+	return vr.Contains(v), nil
+}
+
+// Applies returns true if recipe should be run on conn given the version of
+// the server.
+func Applies(ctx context.Context, recipe MetricQueryRecipe, conn db.Conn) (bool, error) {
+	return recipe.GetVersions().appliesTo(ctx, conn)
+}
+
+// queryApplies returns true if query i of a recipe whose query version
+// ranges are vrs should be run on conn.  vrs may be nil.
+func queryApplies(ctx context.Context, vrs []VersionRange, i int, conn db.Conn) (bool, error) {
+	if i >= len(vrs) {
+		return true, nil
+	}
+	return vrs[i].appliesTo(ctx, conn)
+}
+
+// SortByPriority returns the recipes sorted by decreasing priority.  Recipes
+// with the same priority keep their relative order.
+func SortByPriority(recipes []MetricQueryRecipe) []MetricQueryRecipe {
+	sorted := make([]MetricQueryRecipe, len(recipes))
+	copy(sorted, recipes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetPriority() > sorted[j].GetPriority()
+	})
+	return sorted
+}
+
 type MetricQueryRecipeSimple struct {
 	*MetricQueryRecipeBase
 	// sqlquery is what should be executed
 	Queries []string
+	// QueryVersions, if not nil, limits each of Queries to servers of
+	// certain versions.
+	QueryVersions []VersionRange
 }
 
-func (mqrs *MetricQueryRecipeSimple) Run(conn db.Conn) ([]db.ScannedResultSet, error) {
-	srss, err := mqrs.runQueries(conn)
+func (mqrs *MetricQueryRecipeSimple) Run(ctx context.Context, conn db.Conn) ([]db.ScannedResultSet, error) {
+	srss, err := mqrs.runQueries(ctx, conn)
 	if err != nil {
 		return nil, err
 	}
@@ -86,13 +260,20 @@ func (mqrs *MetricQueryRecipeSimple) Run(conn db.Conn) ([]db.ScannedResultSet, e
 	return srss, err
 }
 
-func (mqrs *MetricQueryRecipeSimple) runQueries(conn db.Conn) ([]db.ScannedResultSet, error) {
+func (mqrs *MetricQueryRecipeSimple) runQueries(ctx context.Context, conn db.Conn) ([]db.ScannedResultSet, error) {
 	var accsrs = make([]db.ScannedResultSet, 0, len(mqrs.Resultmaps))
-	for _, sql := range mqrs.Queries {
+	for i, sql := range mqrs.Queries {
+		if ok, err := queryApplies(ctx, mqrs.QueryVersions, i, conn); err != nil || !ok {
+			if err != nil {
+				return nil, err
+			}
+			log.Debugf("skipping query %d of %q, not for this server version", i+1, mqrs.Namespace)
+			continue
+		}
 		log.Debugln("running SQL: ", sql)
-		srss, err := conn.Query(sql)
+		srss, err := conn.Query(ctx, sql)
 		if err != nil {
-			return nil, fmt.Errorf("Error running query <%s> on database: %v", sql, err)
+			return nil, &db.QueryError{Query: sql, Err: err}
 		}
 		log.Debugln("got results", srss)
 
@@ -103,107 +284,378 @@ func (mqrs *MetricQueryRecipeSimple) runQueries(conn db.Conn) ([]db.ScannedResul
 
 type MetricQueryRecipeTemplated struct {
 	*MetricQueryRecipeBase
-	// Rangequery returns a single-column resultset over which to iterate
-	Rangequery string
+	// Rangequeries yield the rows over which to iterate.  Each is a
+	// template executed once for every row yielded by those before it, so
+	// that ranges can be nested, e.g. the tables of each database.
+	Rangequeries []*template.Template
 	// All templates are executed in the context of a range over the rangequery results.
 	// Each resulting string is executed as an SQL query, and the resulting resultsets
 	// are returned by the ResultSet (after filtering out empty resultsets.)
 	Queries []*template.Template
+	// QueryVersions, if not nil, limits each of Queries to servers of
+	// certain versions.
+	QueryVersions []VersionRange
+	// Parallel, if above 1, is how many items of the range may be run at
+	// once, each on its own connection.
+	Parallel int
 }
 
-// getRange returns the list of strings to iterate over based on the results
-// of the rangeover query.  The query should yield a one-column resultset,
-// the rows of which are returned as a list of strings produced by db.ToString().
-func (mqrt *MetricQueryRecipeTemplated) getRange(conn db.Conn) (string, []string, error) {
-	srss, err := conn.Query(mqrt.Rangequery)
-	if err != nil {
-		return "", nil, err
+// RangeItem is a row yielded by the rangeover queries, mapping column names
+// to values.  Templates refer to its columns as {{.db_name}}; when there's
+// only one column, {{.}} is its value.
+type RangeItem map[string]string
+
+// String implements fmt.Stringer.
+func (ri RangeItem) String() string {
+	names := make([]string, 0, len(ri))
+	for name := range ri {
+		names = append(names, name)
 	}
-	if len(srss) != 1 {
-		return "", nil, fmt.Errorf("rangeover query yielded %d resultsets rather than 1", len(srss))
+	if len(names) == 1 {
+		return ri[names[0]]
 	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + ri[name]
+	}
+	return strings.Join(names, " ")
+}
 
-	srs := srss[0]
-	if len(srs.Colnames) != 1 {
-		return "", nil, fmt.Errorf("rangeover query yielded resultset with other than exactly 1 columns: %v", srs.Colnames)
+// with returns a copy of ri with the columns of row added.
+func (ri RangeItem) with(colnames []string, row []interface{}) (RangeItem, error) {
+	it := make(RangeItem, len(ri)+len(colnames))
+	for name, value := range ri {
+		it[name] = value
 	}
-	if len(srs.Rows) < 1 {
-		return "", nil, fmt.Errorf("rangeover query yielded resultset with no rows")
+	for i, name := range colnames {
+		sval, ok := db.ToString(row[i])
+		if !ok {
+			return nil, fmt.Errorf("rangeover query returned a value I don't know how to handle: %v", row[i])
+		}
+		it[name] = sval
 	}
+	return it, nil
+}
 
-	itover := make([]string, len(srs.Rows))
-	for i, row := range srs.Rows {
-		sval, ok := db.ToString(row[0])
-		if !ok {
-			return "", nil, fmt.Errorf("rangeover query returned a value I don't know how to handle: %v", sval)
+// executeTemplate returns the result of executing tmpl with the given data,
+// binding the template functions that depend on the target and conn.
+func executeTemplate(ctx context.Context, conn db.Conn, tmpl *template.Template, data interface{}) (string, error) {
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Funcs(boundFuncs(ctx, conn)).Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// getRange returns the rows to iterate over based on the results of the
+// rangeover queries, along with the names of all their columns.  Each query
+// should yield a single resultset, and each of its rows is combined with the
+// row of the previous queries it was executed for.  Items for which a nested
+// rangeover query fails are left out and added to ierrs.
+func (mqrt *MetricQueryRecipeTemplated) getRange(ctx context.Context, conn db.Conn, ierrs *ItemErrors) ([]string, []RangeItem, error) {
+	var itnames []string
+	seen := make(map[string]bool)
+	itover := []RangeItem{{}}
+	for _, rangetmpl := range mqrt.Rangequeries {
+		var next []RangeItem
+		for _, it := range itover {
+			sql, err := executeTemplate(ctx, conn, rangetmpl, it)
+			if err != nil {
+				return nil, nil, err
+			}
+			srss, err := conn.Query(ctx, sql)
+			if err != nil {
+				err = &db.QueryError{Query: sql, Err: err}
+				if len(it) == 0 || isFatal(err) {
+					return nil, nil, err
+				}
+				ierrs.add(mqrt.Namespace, it, err)
+				continue
+			}
+			if len(srss) != 1 {
+				return nil, nil, fmt.Errorf("rangeover query yielded %d resultsets rather than 1", len(srss))
+			}
+
+			srs := srss[0]
+			for _, name := range srs.Colnames {
+				if !seen[name] {
+					seen[name] = true
+					itnames = append(itnames, name)
+				}
+			}
+			for _, row := range srs.Rows {
+				nextit, err := it.with(srs.Colnames, row)
+				if err != nil {
+					return nil, nil, err
+				}
+				next = append(next, nextit)
+			}
 		}
-		itover[i] = sval
+		itover = next
 	}
-	return srs.Colnames[0], itover, nil
+	return itnames, itover, nil
 }
 
-func (mqrt *MetricQueryRecipeTemplated) Run(conn db.Conn) ([]db.ScannedResultSet, error) {
-	itname, itover, err := mqrt.getRange(conn)
+func (mqrt *MetricQueryRecipeTemplated) Run(ctx context.Context, conn db.Conn) ([]db.ScannedResultSet, error) {
+	ierrs := &ItemErrors{}
+	itnames, itover, err := mqrt.getRange(ctx, conn, ierrs)
 	if err != nil {
 		return nil, err
 	}
-	return mqrt.runQueries(conn, itname, itover)
+	return mqrt.runQueries(ctx, conn, itnames, itover, ierrs)
+}
+
+// ConnOpener opens another connection to the server a recipe is run on.  It
+// returns ErrNoConns if no more connections are available.
+type ConnOpener func(context.Context) (db.Conn, error)
+
+// ErrNoConns is returned by a ConnOpener when no more connections are
+// available.
+var ErrNoConns = errors.New("no connections available")
+
+type connOpenerKey struct{}
+
+// WithConnOpener returns a context carrying open, which templated recipes
+// with Parallel set use to open the extra connections they need.
+func WithConnOpener(ctx context.Context, open ConnOpener) context.Context {
+	return context.WithValue(ctx, connOpenerKey{}, open)
 }
 
-func (mqrt *MetricQueryRecipeTemplated) runQueries(conn db.Conn, itname string, itover []string) ([]db.ScannedResultSet, error) {
+// ItemErrors is returned by a templated recipe when its queries failed for
+// some of the items of its range but not all of them; the results of the
+// other items are returned along with it.
+type ItemErrors struct {
+	// Items holds the items that failed, and Errs the corresponding errors.
+	Items []RangeItem
+	Errs  []error
+	// Total is the number of items in the range, including those that
+	// failed.
+	Total int
+}
+
+func (ie *ItemErrors) add(namespace string, it RangeItem, err error) {
+	log.Warnf("Error running %q for %v: %v", namespace, it, err)
+	ie.Items = append(ie.Items, it)
+	ie.Errs = append(ie.Errs, err)
+	ie.Total++
+}
+
+func (ie *ItemErrors) Error() string {
+	return fmt.Sprintf("%d of %d items failed, the first (%v) with: %v", len(ie.Errs), ie.Total, ie.Items[0], ie.Errs[0])
+}
+
+// isFatal returns true if err means that the recipe's remaining items can't
+// be run either.
+func isFatal(err error) bool {
+	kind := db.Classify(err)
+	return kind == db.ErrorConnect || kind == db.ErrorTimeout
+}
+
+// itemConns returns the connections on which to run the items of the range:
+// conn, plus as many extra ones as Parallel allows and the context provides
+// for.  The extra connections should be closed once done.
+func (mqrt *MetricQueryRecipeTemplated) itemConns(ctx context.Context, conn db.Conn, items int) []db.Conn {
+	conns := []db.Conn{conn}
+	open, _ := ctx.Value(connOpenerKey{}).(ConnOpener)
+	if open == nil {
+		return conns
+	}
+	for len(conns) < mqrt.Parallel && len(conns) < items {
+		extra, err := open(ctx)
+		if err == ErrNoConns {
+			log.Debugf("No extra connection available for %q, continuing with %d", mqrt.Namespace, len(conns))
+			break
+		}
+		if err != nil {
+			log.Warnf("Unable to open extra connection for %q, continuing with %d: %v", mqrt.Namespace, len(conns), err)
+			break
+		}
+		conns = append(conns, extra)
+	}
+	return conns
+}
+
+func (mqrt *MetricQueryRecipeTemplated) runQueries(ctx context.Context, conn db.Conn, itnames []string, itover []RangeItem, ierrs *ItemErrors) ([]db.ScannedResultSet, error) {
 	log.Debugf("running template queries over range %v", itover)
-	var buf bytes.Buffer
+	results := make([][]db.ScannedResultSet, len(itover))
+	errs := make([]error, len(itover))
+
+	var (
+		wg      sync.WaitGroup
+		fatalMu sync.Mutex
+		fatal   error
+		work    = make(chan int)
+	)
+	conns := mqrt.itemConns(ctx, conn, len(itover))
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c db.Conn) {
+			defer wg.Done()
+			for i := range work {
+				fatalMu.Lock()
+				stop := fatal != nil
+				fatalMu.Unlock()
+				if stop {
+					continue
+				}
+				results[i], errs[i] = mqrt.runItem(ctx, c, itnames, itover[i])
+				if errs[i] != nil && isFatal(errs[i]) {
+					fatalMu.Lock()
+					if fatal == nil {
+						fatal = errs[i]
+					}
+					fatalMu.Unlock()
+				}
+			}
+		}(c)
+	}
+	for i := range itover {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	for _, c := range conns[1:] {
+		c.Close()
+	}
+	if fatal != nil {
+		return nil, fatal
+	}
+
 	var accsrs = make([]db.ScannedResultSet, len(mqrt.Resultmaps))
-	for _, it := range itover {
-		for _, querytmpl := range mqrt.Queries {
-			err := querytmpl.Execute(&buf, it)
+	for i, it := range itover {
+		if errs[i] != nil {
+			ierrs.add(mqrt.Namespace, it, errs[i])
+			continue
+		}
+		ierrs.Total++
+		for j, srs := range results[i] {
+			accsrs[j] = appendRangeItem(accsrs[j], srs, itnames, it)
+		}
+	}
+	log.Debugln("db results", accsrs)
+	switch {
+	case len(ierrs.Errs) == 0:
+		return accsrs, nil
+	case len(ierrs.Errs) == ierrs.Total:
+		return nil, ierrs.Errs[0]
+	}
+	return accsrs, ierrs
+}
+
+// runItem runs the queries for a single item of the range on conn, returning
+// their resultsets combined by position.
+func (mqrt *MetricQueryRecipeTemplated) runItem(ctx context.Context, conn db.Conn, itnames []string, it RangeItem) ([]db.ScannedResultSet, error) {
+	var itsrss []db.ScannedResultSet
+	for i, querytmpl := range mqrt.Queries {
+		if ok, err := queryApplies(ctx, mqrt.QueryVersions, i, conn); err != nil || !ok {
 			if err != nil {
 				return nil, err
 			}
-			sql := buf.String()
-			log.Debugln("running SQL: ", sql)
-			srss, err := conn.Query(sql)
-			if err != nil {
-				return nil, fmt.Errorf("Error running query <%s> on database: %v", sql, err)
-			}
+			continue
+		}
+		sql, err := executeTemplate(ctx, conn, querytmpl, it)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugln("running SQL: ", sql)
+		srss, err := conn.Query(ctx, sql)
+		if err != nil {
+			return nil, &db.QueryError{Query: sql, Err: err}
+		}
 
-			for i, srs := range srss {
-				accsrs[i].Colnames = append(srs.Colnames, itname)
-				for _, row := range srs.Rows {
-					row = append(row, it)
-					accsrs[i].Rows = append(accsrs[i].Rows, row)
-				}
+		for j, srs := range srss {
+			if j >= len(mqrt.Resultmaps) {
+				return nil, fmt.Errorf("query %q yielded %d resultsets and I wanted at most %d", sql, len(srss), len(mqrt.Resultmaps))
 			}
+			if j >= len(itsrss) {
+				itsrss = append(itsrss, db.ScannedResultSet{})
+			}
+			itsrss[j].Colnames = srs.Colnames
+			itsrss[j].Rows = append(itsrss[j].Rows, srs.Rows...)
+		}
+	}
+	return itsrss, nil
+}
 
-			buf.Reset()
+// appendRangeItem appends the rows of srs to acc, adding to each row the
+// columns of it that srs doesn't already have.  Those columns are recorded in
+// acc's LabelColumns.
+func appendRangeItem(acc, srs db.ScannedResultSet, itnames []string, it RangeItem) db.ScannedResultSet {
+	has := make(map[string]bool, len(srs.Colnames))
+	for _, name := range srs.Colnames {
+		has[name] = true
+	}
+	var added []string
+	for _, name := range itnames {
+		if !has[name] {
+			added = append(added, name)
 		}
 	}
-	log.Debugln("db results", accsrs)
-	return accsrs, nil
+
+	acc.Colnames = append(append([]string{}, srs.Colnames...), added...)
+	acc.LabelColumns = added
+	for _, row := range srs.Rows {
+		row = append([]interface{}{}, row...)
+		for _, name := range added {
+			row = append(row, it[name])
+		}
+		acc.Rows = append(acc.Rows, row)
+	}
+	return acc
 }
 
 func DumpMaps(recipes []MetricQueryRecipe) {
 	for _, recipe := range recipes {
 		fmt.Println(recipe.GetNamespace())
+		if interval := recipe.GetInterval(); interval > 0 {
+			fmt.Printf("  interval: %s\n", interval)
+		}
+		if timeout := recipe.GetTimeout(); timeout > 0 {
+			fmt.Printf("  timeout: %s\n", timeout)
+		}
+		if priority := recipe.GetPriority(); priority != 0 {
+			fmt.Printf("  priority: %d\n", priority)
+		}
+		if versions := recipe.GetVersions(); !versions.IsZero() {
+			fmt.Printf("  %s\n", versions)
+		}
+		if when := recipe.GetCondition(); when != nil {
+			fmt.Printf("  when: %s (every %s)\n", when.Query, when.Interval)
+		}
 		fmt.Println("  queries:")
 		if r, ok := recipe.(*MetricQueryRecipeSimple); ok {
-			for _, sql := range r.Queries {
+			for i, sql := range r.Queries {
 				fmt.Printf("    %s\n", sql)
+				if i < len(r.QueryVersions) && !r.QueryVersions[i].IsZero() {
+					fmt.Printf("      %s\n", r.QueryVersions[i])
+				}
 			}
 		} else if r, ok := recipe.(*MetricQueryRecipeTemplated); ok {
-			fmt.Printf("    rangeover: %s\n", r.Rangequery)
-			for _, tmpl := range r.Queries {
-				fmt.Printf("      ")
-				tmpl.Execute(os.Stdout, "{{.}}")
-				fmt.Println()
+			for _, tmpl := range r.Rangequeries {
+				fmt.Printf("    rangeover: %s\n", tmpl.Root)
+			}
+			for i, tmpl := range r.Queries {
+				fmt.Printf("      %s\n", tmpl.Root)
+				if i < len(r.QueryVersions) && !r.QueryVersions[i].IsZero() {
+					fmt.Printf("        %s\n", r.QueryVersions[i])
+				}
 			}
 		}
 
 		fmt.Printf("  resultsets:\n")
 		for _, rm := range recipe.GetResultMaps() {
 			fmt.Printf("    %s:\n", rm.Name)
-			for column, details := range rm.ResultMap {
-				fmt.Printf("      %-40s %v\n", column, details)
+			columns := make([]string, 0, len(rm.ResultMap))
+			for column := range rm.ResultMap {
+				columns = append(columns, column)
+			}
+			sort.Strings(columns)
+			for _, column := range columns {
+				fmt.Printf("      %-40s %v\n", column, rm.ResultMap[column])
 			}
 		}
 		fmt.Println()
@@ -0,0 +1,97 @@
+package recipes
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/ncabatoff/dbms_exporter/db"
+)
+
+// Target describes what a recipe is being run against, for the benefit of
+// query templates.
+type Target struct {
+	// Name is the name of the target, empty unless scraping via /probe or a
+	// targets config file.
+	Name string
+	// Driver is the name of the DB driver, which determines how quoteIdent
+	// and quoteLiteral quote.
+	Driver string
+}
+
+type targetKey struct{}
+
+// WithTarget returns a context carrying target, used by query templates.
+func WithTarget(ctx context.Context, target Target) context.Context {
+	return context.WithValue(ctx, targetKey{}, target)
+}
+
+// TemplateFuncs returns the functions available to query templates.  Those
+// depending on the target or connection only work when executed by
+// executeTemplate; templates must be parsed with these so that they know
+// the names.
+func TemplateFuncs() template.FuncMap {
+	unbound := func(...interface{}) (string, error) {
+		return "", fmt.Errorf("function not available outside of a scrape")
+	}
+	return template.FuncMap{
+		"quoteIdent":    unbound,
+		"quoteLiteral":  unbound,
+		"target":        unbound,
+		"driver":        unbound,
+		"serverVersion": unbound,
+		"env":           env,
+		"lower":         strings.ToLower,
+		"upper":         strings.ToUpper,
+		"trim":          strings.TrimSpace,
+		"trimPrefix":    func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix":    func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"hasPrefix":     func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":     func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"contains":      func(substr, s string) bool { return strings.Contains(s, substr) },
+		"replace":       func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"split":         func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":          func(sep string, a []string) string { return strings.Join(a, sep) },
+	}
+}
+
+// env returns the value of the named environment variable, failing if it's
+// unset like ${VAR} in recipes does.
+func env(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// boundFuncs returns the template functions that depend on the target and
+// connection.
+func boundFuncs(ctx context.Context, conn db.Conn) template.FuncMap {
+	target, _ := ctx.Value(targetKey{}).(Target)
+	return template.FuncMap{
+		// These take any value so that {{quoteIdent .}} works with a
+		// single-column RangeItem.
+		"quoteIdent": func(v interface{}) (string, error) {
+			return db.QuoteIdent(target.Driver, fmt.Sprint(v))
+		},
+		"quoteLiteral": func(v interface{}) (string, error) {
+			return db.QuoteLiteral(target.Driver, fmt.Sprint(v))
+		},
+		"target": func() string {
+			return target.Name
+		},
+		"driver": func() string {
+			return target.Driver
+		},
+		"serverVersion": func() (string, error) {
+			v, err := conn.Version(ctx)
+			if err != nil {
+				return "", err
+			}
+			return v.String(), nil
+		},
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/ncabatoff/dbms_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// Reloader rereads the recipe files on SIGHUP or a POST to /-/reload,
+// swapping the new recipes into the running exporters.  If any file is
+// invalid the old recipes stay in place.
+type Reloader struct {
+	probeHandler *ProbeHandler
+	// exporter, if not nil, is the exporter of the -queryfile recipes
+	// read with the given driver.
+	exporter     *Exporter
+	queriesPaths []string
+	driver       string
+
+	mu          sync.Mutex
+	success     prometheus.Gauge
+	successTime prometheus.Gauge
+}
+
+// NewReloader returns a Reloader for the exporters of ph, plus e if not nil,
+// whose recipes are read from queriesPaths using driver.  Its metrics are
+// registered with the default registry.
+func NewReloader(ph *ProbeHandler, e *Exporter, queriesPaths []string, driver string) *Reloader {
+	rl := &Reloader{
+		probeHandler: ph,
+		exporter:     e,
+		queriesPaths: queriesPaths,
+		driver:       driver,
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "dbms_exporter",
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last recipe reload attempt was successful",
+		}),
+		successTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "dbms_exporter",
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Unix time of the last successful recipe reload",
+		}),
+	}
+	rl.success.Set(1)
+	rl.successTime.SetToCurrentTime()
+	prometheus.MustRegister(rl.success, rl.successTime)
+	return rl
+}
+
+// Reload rereads the recipe files.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	err := rl.reload()
+	if err != nil {
+		log.Errorf("error reloading recipes, keeping the old ones: %v", err)
+		rl.success.Set(0)
+		return err
+	}
+	log.Infof("reloaded recipes")
+	rl.success.Set(1)
+	rl.successTime.SetToCurrentTime()
+	return nil
+}
+
+func (rl *Reloader) reload() error {
+	if rl.exporter == nil {
+		return rl.probeHandler.Reload()
+	}
+	rcps, err := config.ReadRecipesFiles(rl.queriesPaths, rl.driver)
+	if err != nil {
+		return err
+	}
+	if err := rl.probeHandler.Reload(); err != nil {
+		return err
+	}
+	rl.exporter.SetRecipes(rcps)
+	return nil
+}
+
+// ServeHTTP implements http.Handler, reloading on POST requests.
+func (rl *Reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := rl.Reload(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload recipes: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// WatchSignals reloads whenever the process receives SIGHUP.
+func (rl *Reloader) WatchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			rl.Reload()
+		}
+	}()
+}
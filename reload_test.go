@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ncabatoff/dbms_exporter/config"
+	"github.com/ncabatoff/dbms_exporter/db"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const reloadRecipes = `
+  hourly:
+    query: SELECT hourly
+    interval: 1h
+    metrics:
+      - value:
+          usage: GAUGE
+          description: hourly value
+  other:
+    query: SELECT other
+    interval: 1h
+    metrics:
+      - value:
+          usage: GAUGE
+          description: %s
+`
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recipes.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(fmt.Sprintf(reloadRecipes, "other value"))
+	rcps, err := config.ReadRecipesFile(path, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &stubConn{results: map[string][]db.ScannedResultSet{
+		"SELECT hourly": {{Colnames: []string{"value"}, Rows: [][]interface{}{{1.0}}}},
+		"SELECT other":  {{Colnames: []string{"value"}, Rows: [][]interface{}{{2.0}}}},
+		"SELECT 1":      {{Colnames: []string{"1"}, Rows: [][]interface{}{{int64(1)}}}},
+	}}
+	e := NewExporter("postgres", config.StaticDSN("stub"), rcps, ExporterOptions{})
+	e.openDB = func(driver, dsn string) (db.Conn, error) { return conn, nil }
+	rl := &Reloader{
+		probeHandler: NewProbeHandler(nil, nil, ExporterOptions{}),
+		exporter:     e,
+		queriesPaths: []string{path},
+		driver:       "test",
+		success:      prometheus.NewGauge(prometheus.GaugeOpts{Name: "success"}),
+		successTime:  prometheus.NewGauge(prometheus.GaugeOpts{Name: "success_time"}),
+	}
+	checkQueries := func(want ...string) {
+		t.Helper()
+		if !reflect.DeepEqual(conn.queries, want) {
+			t.Errorf("got queries %q, want %q", conn.queries, want)
+		}
+		conn.queries = nil
+	}
+	wantSamples := []string{"test_hourly_value 1", "test_other_value 2"}
+
+	checkSamples(t, scrapeSamples(t, e, "test_"), wantSamples)
+	checkQueries("SELECT hourly", "SELECT other")
+
+	// Only the recipe that changed loses its cached results.
+	write(fmt.Sprintf(reloadRecipes, "other value, redescribed"))
+	if err := rl.Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	checkSamples(t, scrapeSamples(t, e, "test_"), wantSamples)
+	checkQueries("SELECT other")
+
+	// An invalid file leaves the recipes as they were.
+	write("hourly: [")
+	if err := rl.Reload(); err == nil {
+		t.Fatalf("reload of invalid file succeeded")
+	}
+	checkSamples(t, scrapeSamples(t, e, "test_"), wantSamples)
+	checkQueries("SELECT 1")
+	if len(e.recipes) != 2 || e.recipes[1].GetResultMaps()[0].ResultMap["value"].Description != "other value, redescribed" {
+		t.Errorf("recipes changed by failed reload")
+	}
+}